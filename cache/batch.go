@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/alpacahq/slait/utils/log"
+)
+
+// ErrDuplicatePartition is returned when a batch has more than one write to
+// the same partition.
+var ErrDuplicatePartition = errors.New("Partition appears more than once in the batch")
+
+// Write is the entries to append to a partition in a batch.
+type Write struct {
+	Topic     string  `json:"topic"`
+	Partition string  `json:"partition"`
+	Entries   Entries `json:"data"`
+}
+
+// appendMulti appends the writes to their partitions all-or-nothing.  If any of
+// the writes is rejected by the out-of-order policy or fails to persist, the
+// logs already written are truncated back and nothing is appended.  Returns
+// ErrNothingNew if all the writes are stale.  The results are in the order of
+// the writes, and there is one for every write if any of them is rejected.
+func (c *Cache) appendMulti(writes []Write) ([]*AppendResult, error) {
+	seen := map[[2]string]bool{}
+	for _, w := range writes {
+		if err := ValidateTopic(w.Topic); err != nil {
+			return nil, err
+		}
+		if err := ValidatePartition(w.Partition); err != nil {
+			return nil, err
+		}
+		if _, ok := c.topics.Load(w.Topic); !ok && !autoCreate(w.Topic) {
+			return nil, ErrTopicNotFound
+		}
+		key := [2]string{w.Topic, w.Partition}
+		if seen[key] {
+			return nil, ErrDuplicatePartition
+		}
+		seen[key] = true
+	}
+	// the missing partitions are created aside and added only once the batch
+	// is appended, so that a rejected batch leaves nothing behind
+	partitions := make([]*Partition, len(writes))
+	created := make([]bool, len(writes))
+	missing := false
+	for i, w := range writes {
+		partitions[i] = c.partition(w.Topic, w.Partition)
+		missing = missing || partitions[i] == nil
+	}
+	committed := false
+	if missing {
+		c.creating.Lock()
+		defer c.creating.Unlock()
+		defer func() {
+			if !committed {
+				c.discard(writes, partitions, created)
+			}
+		}()
+		for i, w := range writes {
+			// maybe created meanwhile by another append
+			if partitions[i] = c.partition(w.Topic, w.Partition); partitions[i] != nil {
+				continue
+			}
+			p, err := c.newPartition(w.Topic, w.Partition)
+			if err != nil {
+				return nil, &StorageError{err}
+			}
+			partitions[i] = p
+			created[i] = true
+		}
+	}
+	// lock the partitions in the same order to avoid deadlocks
+	order := make([]int, len(writes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := writes[order[i]], writes[order[j]]
+		return a.Topic < b.Topic || (a.Topic == b.Topic && a.Partition < b.Partition)
+	})
+	for _, i := range order {
+		partitions[i].mu.Lock()
+		defer partitions[i].mu.Unlock()
+	}
+
+	pendings := make([]*pendingAppend, len(writes))
+	results := make([]*AppendResult, len(writes))
+	stale := true
+	var rejected error
+	for i, w := range writes {
+		pending, err := partitions[i].prepare(w.Entries, true)
+		if err != nil {
+			return nil, err
+		}
+		pendings[i] = pending
+		results[i] = pending.result
+		if _, ok := pending.err.(*OutOfOrderError); ok && rejected == nil {
+			rejected = pending.err
+		}
+		stale = stale && pending.err == ErrNothingNew
+	}
+	if rejected != nil {
+		return results, rejected
+	}
+	if stale {
+		return results, ErrNothingNew
+	}
+	for i, pending := range pendings {
+		if len(pending.appended) == 0 {
+			continue
+		}
+		if err := pending.write(); err != nil {
+			for _, written := range pendings[:i] {
+				if len(written.appended) > 0 {
+					written.rollback()
+				}
+			}
+			return nil, err
+		}
+	}
+
+	committed = true
+	for i, w := range writes {
+		if created[i] {
+			c.register(w.Topic, w.Partition, partitions[i])
+		}
+	}
+
+	pubs := []*Publication{}
+	for i, pending := range pendings {
+		if len(pending.appended) == 0 {
+			continue
+		}
+		pending.apply()
+		pubs = append(pubs, &Publication{
+			Topic:     writes[i].Topic,
+			Partition: writes[i].Partition,
+			Entries:   pending.appended,
+		})
+		c.LastCommit = CacheCommit{
+			Key:       fmt.Sprintf("%v_%v", writes[i].Topic, writes[i].Partition),
+			Timestamp: pending.appended[len(pending.appended)-1].Timestamp,
+		}
+	}
+	if len(pubs) > 0 {
+		c.router.PublishAll(pubs)
+	}
+	return results, nil
+}
+
+// register adds the partition created by appendMulti along with its topic,
+// and announces them to the subscribers.  The caller must hold c.creating.
+func (c *Cache) register(topic, key string, p *Partition) {
+	top, err := c.loadTopic(topic)
+	if err != nil {
+		log.Error("Failed to add %s/%s: %v", topic, key, err)
+		return
+	}
+	top.partitions.Store(key, p)
+	c.router.Update(topic, key, AddPartition)
+}
+
+// discard removes the partitions created by appendMulti for a batch not
+// appended, along with the directories made for them.
+func (c *Cache) discard(writes []Write, partitions []*Partition, created []bool) {
+	for i, w := range writes {
+		if !created[i] {
+			continue
+		}
+		clog := partitions[i].clog
+		// the directory may hold the entries of a topic removed before
+		if clog.NextOffset() > 0 {
+			clog.Close()
+			continue
+		}
+		if err := clog.DeleteAll(); err != nil {
+			log.Warning("Failed to remove %v: %v", clog.Path, err)
+		}
+		// the topic directory is removed only if it is left empty
+		if _, ok := c.topics.Load(w.Topic); !ok {
+			os.Remove(filepath.Join(c.dataDir, w.Topic))
+		}
+	}
+}
+
+// AppendMulti appends the entries to several partitions all-or-nothing.  The
+// subscribers receive the publications of the partitions together.
+func AppendMulti(writes []Write) ([]*AppendResult, error) {
+	return masterCache.appendMulti(writes)
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"path/filepath"
 	"regexp"
 	"runtime"
 	"runtime/debug"
@@ -23,6 +22,23 @@ import (
 var masterCache Cache
 var cacheStructure = make(map[string]map[string]uint64)
 
+var (
+	// ErrTopicNotFound is returned for the operations on an unknown topic.
+	ErrTopicNotFound = errors.New("Topic does not exist")
+	// ErrNothingNew is returned when none of the entries to append is newer
+	// than the last one in the partition.
+	ErrNothingNew = errors.New("Nothing new to append")
+)
+
+// StorageError is a failure to read or write the commit log of a partition.
+type StorageError struct {
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return e.Err.Error()
+}
+
 const (
 	AddPartition = iota
 	RemovePartition
@@ -34,10 +50,14 @@ type Cache struct {
 	LastCommit CacheCommit
 	dataDir    string
 	router     Router
+	// creating serializes the creation of the partitions on append
+	creating sync.Mutex
 }
 
 type Topic struct {
 	partitions *sync.Map
+	mu         sync.RWMutex
+	meta       *Metadata
 }
 
 type Entries []*Entry
@@ -47,31 +67,86 @@ func (e Entries) Less(i, j int) bool { return e[i].Timestamp.Before(e[j].Timesta
 func (e Entries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
 
 type Partition struct {
-	entries Entries
-	mu      sync.RWMutex
-	clog    *commitlog.CommitLog
+	// lastAccess is the last time in Unix nanosec the partition is read or
+	// written, accessed atomically
+	lastAccess int64
+	entries    Entries
+	// bytes is the approximate memory usage of the entries
+	bytes int64
+	mu    sync.RWMutex
+	clog  *commitlog.CommitLog
+	// memRetention is how long the entries are kept in memory, or 0 to keep
+	// them as long as on disk.  The entries before memFrom are only on disk.
+	memRetention time.Duration
+	memFrom      time.Time
+	// outOfOrder is the policy for the entries older than the last one, and
+	// lateness is the window to accept them in for OutOfOrderLate
+	outOfOrder string
+	lateness   time.Duration
+	// dedup is the IDs of the recent entries to skip the retried ones
+	dedup *dedupWindow
 }
 
 type Entry struct {
 	Timestamp time.Time
 	Data      json.RawMessage
+	// Offset is the sequence number of the entry in the partition, assigned
+	// on append
+	Offset int64
+	// ID is the optional identifier of the entry given by the producer.  The
+	// entries of the IDs recently appended are skipped as retries.
+	ID string `json:"ID,omitempty"`
+}
+
+// slice searches entries in the partition qualified by from and to, at or
+// after offset.  If last is positive, only the last entries up to the number
+// are needed.  The entries evicted from memory are read from disk.
+func (p *Partition) slice(from, to *time.Time, offset int64, last int) Entries {
+	entries, diskTo := p.memSlice(from, to, offset)
+	if diskTo == nil || (last > 0 && len(entries) >= last) {
+		return entries
+	}
+	older, err := p.readDisk(from, diskTo, offset)
+	if err != nil {
+		log.Error("Failed to read %v: %v", p.clog.Path, err)
+		return entries
+	}
+	if len(older) == 0 {
+		return entries
+	}
+	return append(older, entries...)
 }
 
-// slice searches entries in the partition qualified by from and to
-func (p *Partition) slice(from, to *time.Time) Entries {
+// memSlice returns the entries in memory qualified by from and to, at or after
+// offset, and the end of the range to read from disk for the rest of them, or
+// nil if they are all in memory.
+func (p *Partition) memSlice(from, to *time.Time, offset int64) (Entries, *time.Time) {
 	// take a snapshot to avoid concurrent modification (a slice is immutable)
 	p.mu.RLock()
 	entries := p.entries
+	memFrom := p.memFrom
 	p.mu.RUnlock()
+	p.touch()
 
 	start := 0
 	end := len(entries)
+	// the entries on disk are all before offset if it is in memory, unless
+	// the late entries may have been written behind memFrom
+	ordered := p.ordered()
+	inMemory := offset > 0 && ordered && len(entries) > 0 && entries[0].Offset <= offset
 
 	if from != nil {
 		start = sort.Search(len(entries), func(i int) bool {
 			return entries[i].Timestamp.After(*from) || entries[i].Timestamp.Equal(*from)
 		})
 	}
+	if offset > 0 && ordered {
+		if i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].Offset >= offset
+		}); i > start {
+			start = i
+		}
+	}
 	if to != nil {
 		end = sort.Search(len(entries), func(i int) bool {
 			return entries[i].Timestamp.After(*to)
@@ -79,9 +154,148 @@ func (p *Partition) slice(from, to *time.Time) Entries {
 	}
 	if end < start {
 		// should return empty slice?
-		return nil
+		return nil, nil
+	}
+	entries = entries[start:end]
+	if offset > 0 && !ordered {
+		// the offsets of the late entries are out of the timestamp order
+		entries = entries.since(offset)
+	}
+
+	if memFrom.IsZero() || inMemory || (from != nil && !from.Before(memFrom)) {
+		return entries, nil
+	}
+	diskTo := memFrom.Add(-1)
+	if to != nil && to.Before(diskTo) {
+		diskTo = *to
+	}
+	return entries, &diskTo
+}
+
+// readDisk reads the entries qualified by from and to, at or after offset,
+// from the commit log.
+func (p *Partition) readDisk(from, to *time.Time, offset int64) (Entries, error) {
+	reader, err := commitlog.NewReaderRange(p.clog.Path, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if err := reader.SeekOffset(offset); err != nil {
+		return nil, err
+	}
+	reader.Lateness = p.readLateness()
+	return ReadEntries(reader)
+}
+
+// onDisk returns true if there is an entry of the timestamp in the commit log.
+// The first entry of a timestamp is written in order, since the later ones only
+// replace it, so the log is read no further than the timestamp.
+func (p *Partition) onDisk(timestamp time.Time) (bool, error) {
+	reader, err := commitlog.NewReaderRange(p.clog.Path, &timestamp, &timestamp)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	entry, err := reader.Read()
+	return entry != nil, err
+}
+
+// readDiskFirst reads the entries like readDisk, but it stops once it has the
+// first n ones after from.  The late entries are looked for only as far as the
+// lateness past the n-th one.
+func (p *Partition) readDiskFirst(from, to *time.Time, offset int64, n int) (Entries, error) {
+	lateness := p.readLateness()
+	if lateness < 0 {
+		// the replacing entries may be anywhere up to the end
+		return p.readDisk(from, to, offset)
+	}
+	reader, err := commitlog.NewReaderRange(p.clog.Path, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if err := reader.SeekOffset(offset); err != nil {
+		return nil, err
+	}
+	reader.Lateness = lateness
+	entries := Entries{}
+	for {
+		entry, err := reader.Read()
+		if err != nil {
+			return nil, err
+		} else if entry == nil {
+			return entries, nil
+		}
+		start := 0
+		if from != nil {
+			start = sort.Search(len(entries), func(i int) bool {
+				return entries[i].Timestamp.After(*from)
+			})
+		}
+		if len(entries)-start >= n && entry.Timestamp.After(entries[start+n-1].Timestamp.Add(lateness)) {
+			return entries, nil
+		}
+		entries, _ = entries.put(&Entry{
+			Timestamp: entry.Timestamp,
+			Data:      entry.Data,
+			Offset:    entry.Offset,
+			ID:        entry.ID,
+		}, entry.Replace)
 	}
-	return entries[start:end]
+}
+
+// readDiskLast reads the entries like readDisk, but only the last ones up to
+// to, in the windows doubling back from to until it has n ones before to.
+func (p *Partition) readDiskLast(from *time.Time, to time.Time, offset int64, n int) (Entries, error) {
+	lateness := p.readLateness()
+	p.mu.RLock()
+	segments := p.clog.Segments()
+	var first time.Time
+	if len(segments) > 0 {
+		first = time.Unix(0, segments[0].BaseNano)
+	}
+	p.mu.RUnlock()
+	if lateness < 0 || len(segments) == 0 {
+		return p.readDisk(from, &to, offset)
+	}
+	// the late entries may be before the first segment
+	first = first.Add(-lateness)
+	for span := time.Second; ; span *= 2 {
+		start := to.Add(-span)
+		if (from != nil && !start.After(*from)) || !start.After(first) {
+			return p.readDisk(from, &to, offset)
+		}
+		entries, err := p.readDisk(&start, &to, offset)
+		if err != nil {
+			return nil, err
+		}
+		if sort.Search(len(entries), func(i int) bool {
+			return !entries[i].Timestamp.Before(to)
+		}) >= n {
+			return entries, nil
+		}
+	}
+}
+
+// evictExpired drops the entries older than the memory retention from memory.
+// The caller must hold the lock.
+func (p *Partition) evictExpired(now time.Time) {
+	if p.memRetention <= 0 {
+		return
+	}
+	cutoff := now.Add(-p.memRetention)
+	if n := len(p.entries); n > 0 && p.entries[n-1].Timestamp.Before(cutoff) {
+		// keep the last entry to check the order of the new entries
+		cutoff = p.entries[n-1].Timestamp
+	}
+	if !cutoff.After(p.memFrom) {
+		return
+	}
+	start := sort.Search(len(p.entries), func(i int) bool {
+		return !p.entries[i].Timestamp.Before(cutoff)
+	})
+	p.memFrom = cutoff
+	p.drop(start)
 }
 
 // clear clears the content of partition, both on-disk and memory
@@ -90,49 +304,175 @@ func (p *Partition) clear() error {
 	defer p.mu.Unlock()
 	err := p.clog.DeleteAll()
 	p.entries = Entries{}
+	p.bytes = 0
+	p.memFrom = time.Time{}
+	p.dedup.reset()
 	return err
 }
 
 // newPartition creates a new Partition without data in it
 func (c *Cache) newPartition(topic, key string) (*Partition, error) {
-	duration := "120h"
-	for _, plan := range utils.GlobalConfig.TrimConfig {
-		re := regexp.MustCompile(plan.TopicMatch)
-		match := re.FindStringSubmatch(topic)
-		if len(match) != 0 {
-			duration = plan.Duration
-			break
+	if err := ValidatePartition(key); err != nil {
+		return nil, err
+	}
+	opts, err := LogOptions(c.dataDir, topic, key)
+	if err != nil {
+		return nil, err
+	}
+	clog, err := commitlog.New(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	outOfOrder, lateness := ingestPolicy(topic)
+	p := &Partition{
+		lastAccess:   time.Now().UnixNano(),
+		entries:      Entries{},
+		clog:         clog,
+		memRetention: memoryRetention(topic),
+		outOfOrder:   outOfOrder,
+		lateness:     lateness,
+	}
+	p.loadDedupWindow(dedupWindowSize(topic))
+	return p, nil
+}
+
+// LogOptions returns the commitlog options of the partition under dataDir,
+// configured by the topic plans in the global config and the topic metadata.
+func LogOptions(dataDir, topic, key string) (commitlog.Options, error) {
+	opts := commitlog.Options{
+		Path:               PartitionPath(dataDir, topic, key),
+		IndexIntervalBytes: 4 * 1024,
+		CleanerOptions:     cleanerOptions(topic),
+	}
+	meta, err := ReadMetadata(dataDir, topic)
+	if err != nil {
+		return opts, err
+	}
+	if plan := topicPlan(topic); plan != nil {
+		opts.SyncPolicy = commitlog.SyncPolicy(plan.Sync)
+		opts.Codec = commitlog.Codec(plan.Compression)
+		if plan.SegmentBytes != "" {
+			maxBytes, err := bytefmt.ToBytes(plan.SegmentBytes)
+			if err != nil {
+				return opts, err
+			}
+			opts.MaxSegmentBytes = int64(maxBytes)
+		}
+		for _, d := range []struct {
+			value string
+			dest  *time.Duration
+		}{
+			{plan.SyncInterval, &opts.SyncInterval},
+			{plan.SegmentSpan, &opts.MaxSegmentSpan},
+			{plan.SegmentAge, &opts.MaxSegmentAge},
+		} {
+			if d.value == "" {
+				continue
+			}
+			duration, err := time.ParseDuration(d.value)
+			if err != nil {
+				return opts, err
+			}
+			*d.dest = duration
 		}
 	}
-	clog, err := commitlog.New(commitlog.Options{
-		Path: filepath.Join(c.dataDir, topic, key),
-		CleanerOptions: commitlog.CleanerOptions{
+	if meta != nil {
+		if err := meta.apply(&opts); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// cleanerOptions builds the retention policy of the topic from the first
+// matching trim plan.  Multiple policies in the plan are applied together.
+func cleanerOptions(topic string) commitlog.CleanerOptions {
+	plan := trimPlan(topic)
+	if plan == nil {
+		return commitlog.CleanerOptions{
 			"Name":     "Duration",
-			"Duration": duration,
-		},
-	})
+			"Duration": "120h",
+		}
+	}
+	retention := Retention{
+		Duration:   plan.Duration,
+		MaxBytes:   plan.MaxBytes,
+		MaxEntries: plan.MaxEntries,
+	}
+	opts, err := retention.cleanerOptions()
 	if err != nil {
-		return nil, err
+		log.Warning("Invalid retention policy for %s: %v", topic, err)
 	}
+	return opts
+}
 
-	return &Partition{
-		entries: Entries{},
-		clog:    clog,
-	}, err
+// memoryRetention returns the in-memory retention duration of the topic from
+// the first matching trim plan, or 0 if it is the same as on disk.
+func memoryRetention(topic string) time.Duration {
+	plan := trimPlan(topic)
+	if plan == nil || plan.MemoryDuration == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(plan.MemoryDuration)
+	if err != nil {
+		log.Warning("Parsing memory_duration failed for %s: %s, %v", topic, plan.MemoryDuration, err)
+		return 0
+	}
+	return duration
+}
+
+// topicPlan returns the first topic configuration matching the topic, or nil.
+func topicPlan(topic string) *utils.TopicPlan {
+	for i, plan := range utils.GlobalConfig.TopicConfig {
+		if matchTopic(plan.TopicMatch, topic) {
+			return &utils.GlobalConfig.TopicConfig[i]
+		}
+	}
+	return nil
 }
 
-func (c *Cache) get(topic, key string, from, to *time.Time, last int) (entries Entries) {
+// trimPlan returns the first trim plan matching the topic, or nil.
+func trimPlan(topic string) *utils.TrimPlan {
+	for i, plan := range utils.GlobalConfig.TrimConfig {
+		if matchTopic(plan.TopicMatch, topic) {
+			return &utils.GlobalConfig.TrimConfig[i]
+		}
+	}
+	return nil
+}
+
+// topicPatterns is the compiled topic_match patterns of the configuration.
+var topicPatterns sync.Map
+
+// matchTopic returns true if the topic matches the pattern.
+func matchTopic(pattern, topic string) bool {
+	re, ok := topicPatterns.Load(pattern)
+	if !ok {
+		re, _ = topicPatterns.LoadOrStore(pattern, regexp.MustCompile(pattern))
+	}
+	return re.(*regexp.Regexp).MatchString(topic)
+}
+
+// partition returns the partition, or nil if it does not exist.
+func (c *Cache) partition(topic, key string) *Partition {
 	t, ok := c.topics.Load(topic)
 	if !ok {
 		return nil
 	}
-	top := t.(*Topic)
-	p, ok := top.partitions.Load(key)
+	p, ok := t.(*Topic).partitions.Load(key)
 	if !ok {
 		return nil
 	}
-	partition := p.(*Partition)
-	entries = partition.slice(from, to)
+	return p.(*Partition)
+}
+
+func (c *Cache) get(topic, key string, from, to *time.Time, offset int64, last int) (entries Entries) {
+	partition := c.partition(topic, key)
+	if partition == nil {
+		return nil
+	}
+	entries = partition.slice(from, to, offset, last)
 	if last > 0 && len(entries) >= last {
 		return entries[len(entries)-last:]
 	} else {
@@ -151,11 +491,11 @@ func (c *Cache) getAll(topic string, from, to *time.Time, last int) map[string]E
 		func(key, value interface{}) bool {
 			p := value.(*Partition)
 
-			entries := p.slice(from, to)
+			entries := p.slice(from, to, 0, last)
 			if entries == nil {
 				return true
 			}
-			if last > 0 {
+			if last > 0 && len(entries) >= last {
 				data[key.(string)] = entries[len(entries)-last:]
 			} else {
 				data[key.(string)] = entries
@@ -165,44 +505,167 @@ func (c *Cache) getAll(topic string, from, to *time.Time, last int) map[string]E
 	return data
 }
 
-// appendEntries appends entries to the end of partition entries.  Returns error
-// if entries are not ordered in ascending order (duplicate timestamps are allowed).
-// If an entry is missing its timestamp, it is filled here.  Note that this operation
-// is atomic and if one of the entries fail to append, no entries are appended.
-func (c *Cache) appendEntries(topic, key string, entries Entries, new bool) error {
-	t, ok := c.topics.Load(topic)
-	if !ok {
-		return errors.New("Topic does not exist")
+// latest returns the most recent entry qualified by from and to in each
+// partition of the topic.  The partitions with no such entry are omitted.
+func (c *Cache) latest(topic string, from, to *time.Time) map[string]*Entry {
+	all := c.getAll(topic, from, to, 1)
+	if all == nil {
+		return nil
 	}
-	top := t.(*Topic)
-
-	p, ok := top.partitions.Load(key)
-	if !ok {
-		newPart, err := c.newPartition(topic, key)
-		if err != nil {
-			return err
+	data := make(map[string]*Entry, len(all))
+	for key, entries := range all {
+		if len(entries) > 0 {
+			data[key] = entries[len(entries)-1]
 		}
-		top.partitions.Store(key, newPart)
-		p = newPart
-		c.router.Update(topic, key, AddPartition)
 	}
-	partition := p.(*Partition)
+	return data
+}
 
+// appendEntries appends entries to the end of partition entries.  The entries
+// older than the last one are handled by the out-of-order policy of the
+// partition, which is bypassed if new is false.  Returns OutOfOrderError along
+// with the appended entries if the policy rejects some of them (duplicate
+// timestamps are allowed).  If an entry is missing its timestamp, it is filled
+// here.  Note that this operation is atomic and if one of the entries fail to
+// append, no entries are appended.  The new entries are assigned their
+// offsets, and the result tells what is appended and what is dropped.
+func (c *Cache) appendEntries(topic, key string, entries Entries, new bool) (*AppendResult, error) {
+	partition, err := c.loadPartition(topic, key)
+	if err != nil {
+		return nil, err
+	}
 	partition.mu.Lock()
 	defer partition.mu.Unlock()
-	fpos := partition.clog.Tell()
 
+	pending, err := partition.prepare(entries, new)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending.appended) == 0 {
+		return pending.result, pending.err
+	}
+	if new {
+		if err := pending.write(); err != nil {
+			return nil, err
+		}
+	}
+	pending.apply()
+	c.LastCommit = CacheCommit{
+		Key:       fmt.Sprintf("%v_%v", topic, key),
+		Timestamp: pending.appended[len(pending.appended)-1].Timestamp,
+	}
+	return pending.result, pending.err
+}
+
+// loadPartition returns the partition, which is created if it does not exist.
+// The topic is created too if it is allowed by auto_create_topics.
+func (c *Cache) loadPartition(topic, key string) (*Partition, error) {
+	top, err := c.loadTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidatePartition(key); err != nil {
+		return nil, err
+	}
+
+	if p, ok := top.partitions.Load(key); ok {
+		return p.(*Partition), nil
+	}
+	c.creating.Lock()
+	defer c.creating.Unlock()
+	if p, ok := top.partitions.Load(key); ok {
+		return p.(*Partition), nil
+	}
+	p, err := c.newPartition(topic, key)
+	if err != nil {
+		return nil, &StorageError{err}
+	}
+	top.partitions.Store(key, p)
+	c.router.Update(topic, key, AddPartition)
+	return p, nil
+}
+
+// pendingAppend is the entries prepared to be appended to a partition, which
+// are written to disk by write and then to memory by apply.
+type pendingAppend struct {
+	partition *Partition
+	result    *AppendResult
+	// err is the error to return if the entries are appended, or the reason
+	// if none is
+	err      error
+	appended Entries
+	batch    []*commitlog.Entry
+	// merged is the new content of the partition, and added is the change of
+	// its memory usage
+	merged    Entries
+	added     int64
+	lastEntry *Entry
+	// rollback truncates the log back to the position before write
+	rollback func() error
+}
+
+// prepare decides which entries to append by the out-of-order policy and the
+// dedup window, without changing the partition.  The caller must hold the lock.
+func (p *Partition) prepare(entries Entries, new bool) (*pendingAppend, error) {
+	fpos := p.clog.Tell()
+	pending := &pendingAppend{
+		partition: p,
+		rollback:  func() error { return p.clog.Truncate(fpos) },
+	}
+
+	policy := p.outOfOrder
+	if !new {
+		// the entries filled from disk are in order already
+		policy = OutOfOrderDrop
+	}
 	var (
-		firstAppend *int
-		lastEntry   *Entry
-		lastTime    time.Time
+		lastEntry *Entry
+		lastTime  time.Time
+		appended  Entries
+		dropped   []DroppedEntry
+		batch     []*commitlog.Entry
+		// ids is the IDs in the batch to skip the duplicates in it
+		ids        = map[string]bool{}
+		duplicates int
+		// merged is copied before the first insertion since the readers may
+		// hold the current one
+		merged  = p.entries
+		copied  bool
+		added   int64
+		removed Entries
 	)
-	if len(partition.entries) > 0 {
-		lastEntry = partition.entries[len(partition.entries)-1]
+	if len(p.entries) > 0 {
+		lastEntry = p.entries[len(p.entries)-1]
 		lastTime = lastEntry.Timestamp
 	}
+	// exists returns true if there is an entry of the timestamp to replace
+	exists := func(timestamp time.Time) (bool, error) {
+		i := sort.Search(len(merged), func(i int) bool {
+			return !merged[i].Timestamp.Before(timestamp)
+		})
+		if i < len(merged) && merged[i].Timestamp.Equal(timestamp) {
+			return true, nil
+		}
+		if p.memFrom.IsZero() || !timestamp.Before(p.memFrom) {
+			return false, nil
+		}
+		for _, entry := range appended {
+			if entry.Timestamp.Equal(timestamp) {
+				return true, nil
+			}
+		}
+		return p.onDisk(timestamp)
+	}
 
-	for i, entry := range entries {
+	for _, entry := range entries {
+		if new && entry.ID != "" {
+			if ids[entry.ID] || p.dedup.contains(entry.ID) {
+				// appended already by the request being retried
+				duplicates++
+				continue
+			}
+			ids[entry.ID] = true
+		}
 		if entry.Timestamp.IsZero() {
 			// maybe we want to error out in some cases in the future.
 			entry.Timestamp = time.Now()
@@ -214,51 +677,181 @@ func (c *Cache) appendEntries(topic, key string, entries Entries, new bool) erro
 			lastTime = entry.Timestamp
 		}
 
-		if i > 0 {
-			lastEntry = entries[i-1]
-		}
-		// the behavior is to discard the entries that are before the latest
-		// entry in the partition. if other entries in the request are after
+		// by default, the entries that are before the latest entry in the
+		// partition are discarded. if other entries in the request are after
 		// though, they are still appended.
-		if lastEntry != nil && entry.Timestamp.Before(lastEntry.Timestamp) {
-			continue
-		}
-		if firstAppend == nil {
-			tmp := i
-			firstAppend = &tmp
+		inOrder := lastEntry == nil || entry.Timestamp.After(lastEntry.Timestamp) ||
+			(entry.Timestamp.Equal(lastEntry.Timestamp) && policy != OutOfOrderReplace)
+		replace := false
+		if !inOrder {
+			reason := ""
+			switch policy {
+			case OutOfOrderLate:
+				if entry.Timestamp.Before(lastEntry.Timestamp.Add(-p.lateness)) {
+					reason = ReasonTooLate
+				}
+			case OutOfOrderReplace:
+				var err error
+				if replace, err = exists(entry.Timestamp); err != nil {
+					return nil, &StorageError{err}
+				} else if !replace {
+					reason = ReasonNoMatch
+				}
+			default:
+				reason = ReasonOutOfOrder
+			}
+			if reason != "" {
+				dropped = append(dropped, DroppedEntry{Timestamp: entry.Timestamp, Reason: reason})
+				continue
+			}
 		}
+		appended = append(appended, entry)
 		if new {
-			if err := partition.clog.Append(&commitlog.Entry{
+			batch = append(batch, &commitlog.Entry{
 				Timestamp: entry.Timestamp,
-				Data:      entry.Data}); err != nil {
-				log.Error("Failed to persist %v: %v", entry, err)
-				partition.clog.Truncate(fpos)
-				return err
+				Data:      entry.Data,
+				Replace:   replace,
+				ID:        entry.ID})
+		}
+		switch {
+		case inOrder:
+			merged = append(merged, entry)
+			lastEntry = entry
+		case !p.memFrom.IsZero() && entry.Timestamp.Before(p.memFrom):
+			// the entries before memFrom are only on disk
+			continue
+		default:
+			if !copied {
+				merged = append(Entries{}, merged...)
+				copied = true
 			}
+			var r Entries
+			merged, r = merged.put(entry, replace)
+			removed = append(removed, r...)
 		}
+		added += entrySize(entry)
 	}
-	if firstAppend != nil {
-		partition.entries = append(partition.entries, entries[*firstAppend:]...)
-	} else {
-		return errors.New("Nothing new to append")
+	for _, entry := range removed {
+		added -= entrySize(entry)
 	}
 
-	c.LastCommit = CacheCommit{
-		Key:       fmt.Sprintf("%v_%v", topic, key),
-		Timestamp: entries[entries.Len()-1].Timestamp,
+	pending.result = &AppendResult{
+		Duplicates:     duplicates,
+		Dropped:        len(dropped),
+		DroppedEntries: dropped,
+		LastOffset:     p.clog.NextOffset() - 1,
+	}
+	if lastEntry != nil {
+		pending.result.LastTimestamp = lastEntry.Timestamp
+	}
+	pending.appended = appended
+	pending.batch = batch
+	pending.merged = merged
+	pending.added = added
+	pending.lastEntry = lastEntry
+	if len(dropped) > 0 && policy != OutOfOrderDrop {
+		pending.err = &OutOfOrderError{Dropped: dropped}
+	} else if len(appended) == 0 && duplicates == 0 {
+		pending.err = ErrNothingNew
+	}
+	// otherwise a retried request is acknowledged again
+	return pending, nil
+}
+
+// write persists the entries to the commit log.  The log is truncated back on
+// failure.
+func (pending *pendingAppend) write() error {
+	clog := pending.partition.clog
+	// AppendBatch rolls back by itself on failure
+	if err := clog.AppendBatch(pending.batch); err != nil {
+		log.Error("Failed to persist %v: %v", clog.Path, err)
+		return &StorageError{err}
+	}
+	if err := clog.Commit(); err != nil {
+		log.Error("Failed to commit %v: %v", clog.Path, err)
+		pending.rollback()
+		return &StorageError{err}
 	}
 	return nil
 }
 
+// apply updates the partition in memory with the written entries.
+func (pending *pendingAppend) apply() {
+	p := pending.partition
+	for i, entry := range pending.batch {
+		pending.appended[i].Offset = entry.Offset
+		if entry.ID != "" {
+			p.dedup.add(entry.ID)
+		}
+	}
+	p.bytes += pending.added
+	p.entries = pending.merged
+	p.touch()
+
+	pending.result.Accepted = len(pending.appended)
+	pending.result.appended = pending.appended
+	pending.result.LastOffset = p.clog.NextOffset() - 1
+	if pending.lastEntry != nil {
+		pending.result.LastTimestamp = pending.lastEntry.Timestamp
+	}
+}
+
 func (c *Cache) addTopic(topic string) error {
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
 	if _, ok := c.topics.Load(topic); !ok {
-		c.topics.Store(topic, &Topic{partitions: &sync.Map{}})
+		// the metadata is kept on disk across the removal of the topic
+		meta, err := ReadMetadata(c.dataDir, topic)
+		if err != nil {
+			log.Warning("Reading metadata failed: %v", err)
+		}
+		c.topics.Store(topic, &Topic{partitions: &sync.Map{}, meta: meta})
 		return nil
 	} else {
 		return errors.New("Topic already exists")
 	}
 }
 
+// loadTopic returns the topic, which is created and announced to the
+// subscribers if it does not exist and matches auto_create_topics.
+func (c *Cache) loadTopic(topic string) (*Topic, error) {
+	if t, ok := c.topics.Load(topic); ok {
+		return t.(*Topic), nil
+	}
+	if err := ValidateTopic(topic); err != nil {
+		return nil, err
+	}
+	if !autoCreate(topic) {
+		return nil, ErrTopicNotFound
+	}
+	meta, err := ReadMetadata(c.dataDir, topic)
+	if err != nil {
+		log.Warning("Reading metadata failed: %v", err)
+	}
+	t, loaded := c.topics.LoadOrStore(topic, &Topic{partitions: &sync.Map{}, meta: meta})
+	if !loaded {
+		log.Info("Topic %s created automatically", topic)
+		c.router.Add(topic)
+	}
+	return t.(*Topic), nil
+}
+
+// autoCreate returns true if the topic matches any of auto_create_topics.
+func autoCreate(topic string) bool {
+	for _, pattern := range utils.GlobalConfig.AutoCreateTopics {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Warning("Invalid auto_create_topics pattern: %s, %v", pattern, err)
+			continue
+		}
+		if re.MatchString(topic) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Cache) removeTopic(topic string) {
 	c.topics.Delete(topic)
 }
@@ -266,7 +859,7 @@ func (c *Cache) removeTopic(topic string) {
 func (c *Cache) updateTopic(topic, key string, action int) error {
 	t, ok := c.topics.Load(topic)
 	if !ok {
-		return errors.New("Topic does not exist")
+		return ErrTopicNotFound
 	}
 	top := t.(*Topic)
 	p, ok := top.partitions.Load(key)
@@ -312,6 +905,7 @@ func (c *Cache) trimTopic(topic string) {
 			p.mu.Lock()
 			defer p.mu.Unlock()
 
+			p.evictExpired(time.Now())
 			upto, err := p.clog.Trim()
 			if err != nil {
 				log.Error("Error while trimming %v: %v", topic, err)
@@ -323,10 +917,7 @@ func (c *Cache) trimTopic(topic string) {
 			start := sort.Search(len(p.entries), func(i int) bool {
 				return p.entries[i].Timestamp.After(upto) || p.entries[i].Timestamp.Equal(upto)
 			})
-			// free the memory
-			e := make(Entries, len(p.entries[start:]))
-			copy(e, p.entries[start:])
-			p.entries = e
+			p.drop(start)
 			return true
 		})
 	}
@@ -365,21 +956,47 @@ func Catalog() map[string]map[string]int {
 }
 
 func Get(topic, key string, from, to *time.Time, last int) (entries Entries) {
-	return masterCache.get(topic, key, from, to, last)
+	return masterCache.get(topic, key, from, to, 0, last)
+}
+
+// GetOffset is Get for the entries at or after offset.
+func GetOffset(topic, key string, offset int64, from, to *time.Time, last int) (entries Entries) {
+	return masterCache.get(topic, key, from, to, offset, last)
 }
 
 func GetAll(topic string, from, to *time.Time, last int) map[string]Entries {
 	return masterCache.getAll(topic, from, to, last)
 }
 
+// GetPage is GetOffset for a page of up to limit entries next to the cursor,
+// which is Next or Prev of the previous page.  Pass the same from, to and
+// offset for all the pages.  Without a cursor, the page is the first entries,
+// or the last ones if fromEnd is true.
+func GetPage(topic, key string, offset int64, from, to *time.Time, cursor string, limit int, fromEnd bool) (*Page, error) {
+	return masterCache.getPage(topic, key, offset, from, to, cursor, limit, fromEnd)
+}
+
+// Latest returns the most recent entry in each partition of the topic, or nil
+// if the topic does not exist.  If to is given, it is the latest as of then.
+func Latest(topic string, from, to *time.Time) map[string]*Entry {
+	return masterCache.latest(topic, from, to)
+}
+
 func Append(topic, partition string, entries Entries) (err error) {
-	err = masterCache.appendEntries(topic, partition, entries, true)
-	if err == nil {
-		masterCache.router.Publish(topic, partition, entries)
-	}
+	_, err = AppendResults(topic, partition, entries)
 	return err
 }
 
+// AppendResults is Append that also returns what is appended and dropped.  The
+// result is nil if the topic does not exist or the entries fail to persist.
+func AppendResults(topic, partition string, entries Entries) (*AppendResult, error) {
+	result, err := masterCache.appendEntries(topic, partition, entries, true)
+	if result != nil && len(result.appended) > 0 {
+		masterCache.router.Publish(topic, partition, result.appended)
+	}
+	return result, err
+}
+
 func Add(topic string) (err error) {
 	err = masterCache.addTopic(topic)
 	if err == nil {
@@ -388,6 +1005,13 @@ func Add(topic string) (err error) {
 	return err
 }
 
+// Ensure creates the topic if it does not exist and matches
+// auto_create_topics.  Returns ErrTopicNotFound if it is not created.
+func Ensure(topic string) error {
+	_, err := masterCache.loadTopic(topic)
+	return err
+}
+
 func Remove(topic string) {
 	masterCache.removeTopic(topic)
 	masterCache.router.Remove(topic)
@@ -412,20 +1036,45 @@ func Trim() {
 		return true
 	}
 	masterCache.topics.Range(f)
+	evicted := masterCache.enforceLimits()
 	debug.FreeOSMemory()
 	runtime.ReadMemStats(&m)
 	memEnd := m.Alloc
+	usage := masterCache.usage()
 	log.Info("Cache trimmed in %v", time.Now().Sub(start))
 	log.Info(
-		"Trim stats | MemStart: %v MemEnd: %v MemFreed: %v",
+		"Trim stats | MemStart: %v MemEnd: %v MemFreed: %v CacheSize: %v CacheLimit: %v Evicted: %v",
 		bytefmt.ByteSize(memStart),
 		bytefmt.ByteSize(memEnd),
 		bytefmt.ByteSize(memStart-memEnd),
+		bytefmt.ByteSize(uint64(usage.Bytes)),
+		bytefmt.ByteSize(uint64(usage.Limit)),
+		bytefmt.ByteSize(uint64(evicted)),
 	)
 }
 
+// Sync commits the appended entries of the partitions to the disk if their
+// sync interval has passed.
+func Sync() {
+	masterCache.topics.Range(func(key, value interface{}) bool {
+		t := value.(*Topic)
+		t.partitions.Range(func(pkey, pvalue interface{}) bool {
+			p := pvalue.(*Partition)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if err := p.clog.Commit(); err != nil {
+				log.Error("Failed to sync %v/%v: %v", key, pkey, err)
+			}
+			return true
+		})
+		return true
+	})
+}
+
 func Fill() error {
-	return masterCache.fill()
+	err := masterCache.fill()
+	masterCache.enforceLimits()
+	return err
 }
 
 type CacheCommit struct {
@@ -437,7 +1086,7 @@ func LastCommit() CacheCommit {
 	return masterCache.LastCommit
 }
 
-// TODO: implement cache size calculation
+// Size returns the approximate memory usage of the cached entries in bytes.
 func Size() (size int) {
-	return size
+	return int(masterCache.usage().Bytes)
 }
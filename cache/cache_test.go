@@ -2,11 +2,16 @@ package cache
 
 import (
 	"bytes"
+	"fmt"
 	"math"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/alpacahq/slait/commitlog"
+	"github.com/alpacahq/slait/utils"
 	. "gopkg.in/check.v1"
 )
 
@@ -100,6 +105,17 @@ func (s *CacheTestSuite) TestCache(c *C) {
 	end = quoteData[4].Timestamp.Add(-30 * time.Second)
 	allQuotes = GetAll("quotes", &time.Time{}, &end, 0)
 	c.Assert(DataEqual(allQuotes["NVDA_composite"], quoteData[0:4]), Equals, true)
+	// more than in the partition
+	allBars = GetAll("bars", &barData[3].Timestamp, nil, 3)
+	c.Assert(DataEqual(allBars["AMD_bats"], barData[3:]), Equals, true)
+
+	// Get the latest entry of each partition
+	latest := Latest("bars", nil, nil)
+	c.Assert(len(latest), Equals, 2)
+	c.Assert(latest["AMD_bats"].Timestamp.Equal(barData[len(barData)-1].Timestamp), Equals, true)
+	latest = Latest("bars", nil, &barData[2].Timestamp)
+	c.Assert(latest["AMD_bats"].Timestamp.Equal(barData[2].Timestamp), Equals, true)
+	c.Assert(Latest("some other type", nil, nil), IsNil)
 
 	// Remove a partition
 	err = Update("bars", "AMD_bats", RemovePartition)
@@ -152,7 +168,8 @@ func (s *CacheTestSuite) TestCache(c *C) {
 
 	// Get cache size
 	size := Size()
-	c.Assert(size, Equals, 0)
+	c.Assert(size > 0, Equals, true)
+	c.Assert(size, Equals, int(MemoryUsage().Bytes))
 
 	// Clear a partition
 	err = Update("quotes", "NVDA_composite", ClearPartition)
@@ -203,3 +220,810 @@ func (s *CacheTestSuite) TestTrim(c *C) {
 	results2 := Get("topic1", "key1", nil, nil, 0)
 	c.Assert(len(results2), Equals, 5)
 }
+
+func (s *CacheTestSuite) TestCleanerOptions(c *C) {
+	defer func(config []utils.TrimPlan) {
+		utils.GlobalConfig.TrimConfig = config
+	}(utils.GlobalConfig.TrimConfig)
+	utils.GlobalConfig.TrimConfig = []utils.TrimPlan{
+		{TopicMatch: "bars*", Duration: "24h", MaxBytes: "2G"},
+		{TopicMatch: "quotes*", MaxEntries: 1000},
+	}
+
+	opts := cleanerOptions("bars")
+	c.Assert(opts["Name"], Equals, "Composite")
+	c.Assert(opts["Duration"], Equals, "24h")
+	c.Assert(opts["MaxLogBytes"], Equals, "2147483648")
+
+	opts = cleanerOptions("quotes")
+	c.Assert(opts["Name"], Equals, "EntryCount")
+	c.Assert(opts["MaxEntries"], Equals, "1000")
+
+	opts = cleanerOptions("trades")
+	c.Assert(opts["Name"], Equals, "Duration")
+	c.Assert(opts["Duration"], Equals, "120h")
+}
+
+func (s *CacheTestSuite) TestLogOptions(c *C) {
+	defer func(config []utils.TopicPlan) {
+		utils.GlobalConfig.TopicConfig = config
+	}(utils.GlobalConfig.TopicConfig)
+	utils.GlobalConfig.TopicConfig = []utils.TopicPlan{
+		{TopicMatch: "bars*", Sync: "interval", SyncInterval: "1s", SegmentBytes: "1M", SegmentSpan: "1h"},
+	}
+
+	opts, err := LogOptions("/data", "bars", "AAPL")
+	c.Assert(err, IsNil)
+	c.Assert(opts.Path, Equals, "/data/bars/AAPL")
+	c.Assert(opts.SyncPolicy, Equals, commitlog.SyncInterval)
+	c.Assert(opts.SyncInterval, Equals, time.Second)
+	c.Assert(opts.MaxSegmentBytes, Equals, int64(1024*1024))
+	c.Assert(opts.MaxSegmentSpan, Equals, time.Hour)
+
+	utils.GlobalConfig.TopicConfig[0].SegmentSpan = "1 hour"
+	_, err = LogOptions("/data", "bars", "AAPL")
+	c.Assert(err, NotNil)
+}
+
+func (s *CacheTestSuite) TestSnapshot(c *C) {
+	Build(c.MkDir())
+	Add("topic1")
+	Add("topic2")
+	Update("topic1", "key1", AddPartition)
+	topic1, _ := masterCache.topics.Load("topic1")
+	key1, _ := topic1.(*Topic).partitions.Load("key1")
+	// switch segments every few records so that some are sealed
+	key1.(*Partition).clog.MaxSegmentBytes = 64
+	Append("topic1", "key1", GenData())
+
+	defer func(dir string) {
+		utils.GlobalConfig.SnapshotDir = dir
+	}(utils.GlobalConfig.SnapshotDir)
+	utils.GlobalConfig.SnapshotDir = ""
+	_, err := Snapshot("snap")
+	c.Assert(err, Equals, ErrSnapshotsDisabled)
+	// only under snapshot_dir and outside of the data directory
+	utils.GlobalConfig.SnapshotDir = c.MkDir()
+	for _, path := range []string{"", "../snap", c.MkDir()} {
+		_, err = Snapshot(path)
+		c.Assert(err, FitsTypeOf, &NameError{})
+	}
+	utils.GlobalConfig.SnapshotDir = masterCache.dataDir
+	_, err = Snapshot("topic3")
+	c.Assert(err, FitsTypeOf, &NameError{})
+	_, err = os.Stat(filepath.Join(masterCache.dataDir, "topic3"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	utils.GlobalConfig.SnapshotDir = c.MkDir()
+	snapDir := filepath.Join(utils.GlobalConfig.SnapshotDir, "snap")
+	manifest, err := Snapshot("snap")
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Topics, DeepEquals, []string{"topic1", "topic2"})
+	c.Assert(len(manifest.Partitions), Equals, 1)
+	c.Assert(len(manifest.Partitions[0].Files) > 1, Equals, true)
+
+	// the entries appended later are not in the snapshot
+	Append("topic1", "key1", Entries{{Timestamp: time.Now(), Data: []byte("{}")}})
+
+	_, err = Snapshot(snapDir)
+	c.Assert(err, NotNil)
+
+	dataDir := filepath.Join(c.MkDir(), "data")
+	_, err = Restore(snapDir, dataDir)
+	c.Assert(err, IsNil)
+	reader, err := commitlog.NewReader(filepath.Join(dataDir, "topic1", "key1"))
+	c.Assert(err, IsNil)
+	defer reader.Close()
+	count := 0
+	for {
+		entry, err := reader.Read()
+		c.Assert(err, IsNil)
+		if entry == nil {
+			break
+		}
+		count++
+	}
+	c.Assert(count, Equals, 5)
+	_, err = os.Stat(filepath.Join(dataDir, "topic2"))
+	c.Assert(err, IsNil)
+
+	_, err = Restore(snapDir, dataDir)
+	c.Assert(err, NotNil)
+}
+
+func (s *CacheTestSuite) TestMemoryRetention(c *C) {
+	defer func(config []utils.TrimPlan) {
+		utils.GlobalConfig.TrimConfig = config
+	}(utils.GlobalConfig.TrimConfig)
+	utils.GlobalConfig.TrimConfig = []utils.TrimPlan{
+		{TopicMatch: "quotes", Duration: "720h", MemoryDuration: "1h"},
+	}
+	dataDir := c.MkDir()
+	Build(dataDir)
+	Add("quotes")
+	Update("quotes", "key1", AddPartition)
+	now := time.Now()
+	var entries Entries
+	for _, ago := range []time.Duration{3 * time.Hour, 2 * time.Hour, 30 * time.Minute, 10 * time.Minute} {
+		entries = append(entries, &Entry{Timestamp: now.Add(-ago), Data: []byte("{}")})
+	}
+	Append("quotes", "key1", entries)
+	Trim()
+
+	partition := masterCache.partition("quotes", "key1")
+	c.Assert(len(partition.entries), Equals, 2)
+	c.Assert(len(Get("quotes", "key1", nil, nil, 0)), Equals, 4)
+	from := now.Add(-150 * time.Minute)
+	c.Assert(len(Get("quotes", "key1", &from, nil, 0)), Equals, 3)
+	to := now.Add(-90 * time.Minute)
+	c.Assert(len(Get("quotes", "key1", nil, &to, 0)), Equals, 2)
+	c.Assert(len(Get("quotes", "key1", &from, &to, 0)), Equals, 1)
+	results := Get("quotes", "key1", nil, nil, 3)
+	c.Assert(len(results), Equals, 3)
+	c.Assert(results[0].Timestamp.Equal(entries[1].Timestamp), Equals, true)
+
+	// an old entry is still out of order after the eviction
+	c.Assert(Append("quotes", "key1", Entries{{Timestamp: now.Add(-time.Hour), Data: []byte("{}")}}), NotNil)
+
+	// only the recent entries are loaded on start
+	Build(dataDir)
+	Fill()
+	partition = masterCache.partition("quotes", "key1")
+	c.Assert(len(partition.entries), Equals, 2)
+	c.Assert(len(Get("quotes", "key1", nil, nil, 0)), Equals, 4)
+}
+
+func (s *CacheTestSuite) TestMemoryLimit(c *C) {
+	defer func(config utils.SlaitConfig) {
+		utils.GlobalConfig = config
+	}(utils.GlobalConfig)
+	utils.GlobalConfig.TrimConfig = []utils.TrimPlan{
+		{TopicMatch: "quotes", MemoryLimit: "1K"},
+	}
+	Build(c.MkDir())
+	Add("quotes")
+	Add("bars")
+	now := time.Now()
+	data := []byte(strings.Repeat("x", 100))
+	for _, key := range []string{"idle", "active"} {
+		var entries Entries
+		for i := 0; i < 10; i++ {
+			entries = append(entries, &Entry{Timestamp: now.Add(time.Duration(i-10) * time.Second), Data: data})
+		}
+		Append("quotes", key, entries)
+		Append("bars", key, entries)
+	}
+	entrySize := entryOverhead + int64(len(data))
+	usage := MemoryUsage()
+	c.Assert(usage.Bytes, Equals, 40*entrySize)
+	c.Assert(usage.Topics["quotes"].Bytes, Equals, 20*entrySize)
+	c.Assert(usage.Topics["quotes"].Limit, Equals, int64(1024))
+	c.Assert(usage.Topics["quotes"].Partitions["idle"].Entries, Equals, 10)
+
+	// the idle partition is evicted first, keeping the last entry
+	Get("quotes", "active", nil, nil, 0)
+	Trim()
+	usage = MemoryUsage()
+	c.Assert(usage.Topics["quotes"].Bytes <= 1024, Equals, true)
+	c.Assert(usage.Topics["quotes"].Partitions["idle"].Entries, Equals, 1)
+	c.Assert(usage.Topics["quotes"].Partitions["active"].Entries, Equals, 5)
+	c.Assert(usage.Topics["bars"].Bytes, Equals, 20*entrySize)
+	// the evicted entries are still read from disk
+	c.Assert(len(Get("quotes", "idle", nil, nil, 0)), Equals, 10)
+
+	utils.GlobalConfig.MemoryLimit = "2K"
+	Trim()
+	usage = MemoryUsage()
+	c.Assert(usage.Bytes <= 2048, Equals, true)
+	c.Assert(len(Get("bars", "active", nil, nil, 0)), Equals, 10)
+
+	// the IDs count too
+	Add("trades")
+	c.Assert(Append("trades", "AMD", Entries{{Timestamp: now, Data: data, ID: "trade-1"}}), IsNil)
+	c.Assert(MemoryUsage().Topics["trades"].Bytes, Equals, entrySize+7)
+}
+
+func (s *CacheTestSuite) TestMetadata(c *C) {
+	dataDir := c.MkDir()
+	Build(dataDir)
+	Add("bars")
+	Update("bars", "AMD", AddPartition)
+	p := masterCache.partition("bars", "AMD")
+	// switch segments every few records so that some are sealed
+	p.clog.MaxSegmentBytes = 64
+	Append("bars", "AMD", GenData())
+
+	meta, err := GetMetadata("bars")
+	c.Assert(err, IsNil)
+	c.Assert(*meta, DeepEquals, Metadata{})
+	_, err = GetMetadata("quotes")
+	c.Assert(err, NotNil)
+
+	// invalid values are rejected without being written
+	err = SetMetadata("bars", &Metadata{Retention: &Retention{Duration: "1 day"}})
+	c.Assert(err, NotNil)
+	_, err = os.Stat(filepath.Join(dataDir, "bars", MetadataFile))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// the retention takes effect on the next trim
+	meta = &Metadata{
+		Description:  "1 minute bars",
+		Retention:    &Retention{MaxEntries: 2},
+		SegmentBytes: "1K",
+		Labels:       map[string]string{"source": "bats"},
+	}
+	c.Assert(SetMetadata("bars", meta), IsNil)
+	c.Assert(p.clog.CleanerOptions["Name"], Equals, "EntryCount")
+	c.Assert(p.clog.MaxSegmentBytes, Equals, int64(1024))
+	_, err = p.clog.Trim()
+	c.Assert(err, IsNil)
+	count := int64(0)
+	for _, segment := range p.clog.Segments() {
+		n, err := segment.EntryCount()
+		c.Assert(err, IsNil)
+		count += n
+	}
+	c.Assert(count < 6, Equals, true)
+
+	// the metadata is loaded on start
+	Build(dataDir)
+	Fill()
+	loaded, err := GetMetadata("bars")
+	c.Assert(err, IsNil)
+	c.Assert(loaded, DeepEquals, meta)
+	c.Assert(masterCache.partition("bars", "AMD").clog.CleanerOptions["Name"], Equals, "EntryCount")
+}
+
+func (s *CacheTestSuite) TestOffsets(c *C) {
+	dataDir := c.MkDir()
+	Build(dataDir)
+	Add("bars")
+	data := GenData()
+	c.Assert(Append("bars", "AMD", data[:3]), IsNil)
+	// the entries out of order are neither appended nor assigned offsets
+	result, err := AppendResults("bars", "AMD", Entries{data[0], data[3], data[2], data[4]})
+	c.Assert(err, IsNil)
+	c.Assert(result.Accepted, Equals, 2)
+	c.Assert(result.Dropped, Equals, 2)
+	c.Assert(result.DroppedEntries[1], Equals, DroppedEntry{data[2].Timestamp, ReasonOutOfOrder})
+	c.Assert(result.LastOffset, Equals, int64(4))
+	c.Assert(result.LastTimestamp.Equal(data[4].Timestamp), Equals, true)
+	result, err = AppendResults("bars", "AMD", data[:1])
+	c.Assert(err, Equals, ErrNothingNew)
+	c.Assert(result.Dropped, Equals, 1)
+	_, err = AppendResults("trades", "AMD", data[:1])
+	c.Assert(err, Equals, ErrTopicNotFound)
+	for i, entry := range data {
+		c.Assert(entry.Offset, Equals, int64(i))
+	}
+	results := Get("bars", "AMD", nil, nil, 0)
+	c.Assert(DataEqual(results, data), Equals, true)
+
+	results = GetOffset("bars", "AMD", 3, nil, nil, 0)
+	c.Assert(len(results), Equals, 2)
+	c.Assert(results[0].Offset, Equals, int64(3))
+	results = GetOffset("bars", "AMD", 1, nil, &data[2].Timestamp, 0)
+	c.Assert(len(results), Equals, 2)
+	c.Assert(len(GetOffset("bars", "AMD", 5, nil, nil, 0)), Equals, 0)
+
+	// the offsets are read from disk
+	p := masterCache.partition("bars", "AMD")
+	p.mu.Lock()
+	p.evictBytes(3 * entrySize(data[0]))
+	p.mu.Unlock()
+	results = GetOffset("bars", "AMD", 1, nil, nil, 0)
+	c.Assert(len(results), Equals, 4)
+	c.Assert(results[0].Offset, Equals, int64(1))
+
+	Build(dataDir)
+	Fill()
+	c.Assert(Append("bars", "AMD", Entries{{Timestamp: time.Now(), Data: []byte("{}")}}), IsNil)
+	results = GetOffset("bars", "AMD", 4, nil, nil, 0)
+	c.Assert(len(results), Equals, 2)
+	c.Assert(results[1].Offset, Equals, int64(5))
+}
+
+func (s *CacheTestSuite) TestOutOfOrder(c *C) {
+	defer func(config []utils.TopicPlan) {
+		utils.GlobalConfig.TopicConfig = config
+	}(utils.GlobalConfig.TopicConfig)
+	utils.GlobalConfig.TopicConfig = []utils.TopicPlan{
+		{TopicMatch: "^rejected$", OutOfOrder: OutOfOrderReject},
+		{TopicMatch: "^late$", OutOfOrder: OutOfOrderLate, Lateness: "10s"},
+		{TopicMatch: "^replaced$", OutOfOrder: OutOfOrderReplace},
+	}
+	dataDir := c.MkDir()
+	Build(dataDir)
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	at := func(msec int, data string) *Entry {
+		return &Entry{
+			Timestamp: t0.Add(time.Duration(msec) * time.Millisecond),
+			Data:      []byte(`"` + data + `"`),
+		}
+	}
+	payloads := func(entries Entries) []string {
+		results := []string{}
+		for _, entry := range entries {
+			results = append(results, strings.Trim(string(entry.Data), `"`))
+		}
+		return results
+	}
+	// dropped returns the timestamps of the dropped entries in msec from t0
+	dropped := func(err error) []int {
+		c.Assert(err, FitsTypeOf, &OutOfOrderError{})
+		results := []int{}
+		for _, entry := range err.(*OutOfOrderError).Dropped {
+			results = append(results, int(entry.Timestamp.Sub(t0)/time.Millisecond))
+		}
+		return results
+	}
+
+	// the dropped entries are reported, and the others are still appended
+	Add("rejected")
+	c.Assert(Append("rejected", "AMD", Entries{at(0, "0"), at(1000, "1"), at(2000, "2")}), IsNil)
+	err := Append("rejected", "AMD", Entries{at(1500, "1h"), at(3000, "3")})
+	c.Assert(dropped(err), DeepEquals, []int{1500})
+	c.Assert(payloads(Get("rejected", "AMD", nil, nil, 0)), DeepEquals, []string{"0", "1", "2", "3"})
+	err = Append("rejected", "AMD", Entries{at(1500, "1h")})
+	c.Assert(dropped(err), DeepEquals, []int{1500})
+
+	// the late entries are inserted in the timestamp order
+	Add("late")
+	c.Assert(Append("late", "AMD", Entries{at(0, "0"), at(20000, "20"), at(30000, "30")}), IsNil)
+	err = Append("late", "AMD", Entries{at(25000, "25"), at(0, "0b"), at(31000, "31")})
+	c.Assert(dropped(err), DeepEquals, []int{0})
+	expected := []string{"0", "20", "25", "30", "31"}
+	c.Assert(payloads(Get("late", "AMD", nil, nil, 0)), DeepEquals, expected)
+	c.Assert(payloads(GetOffset("late", "AMD", 3, nil, nil, 0)), DeepEquals, []string{"25", "31"})
+
+	// and read from disk in the same order
+	p := masterCache.partition("late", "AMD")
+	p.mu.Lock()
+	p.evictBytes(p.bytes)
+	p.mu.Unlock()
+	c.Assert(len(p.entries), Equals, 1)
+	c.Assert(payloads(Get("late", "AMD", nil, nil, 0)), DeepEquals, expected)
+	from, to := t0.Add(20*time.Second), t0.Add(29*time.Second)
+	c.Assert(payloads(Get("late", "AMD", &from, &to, 0)), DeepEquals, []string{"20", "25"})
+	c.Assert(payloads(GetOffset("late", "AMD", 3, nil, nil, 0)), DeepEquals, []string{"25", "31"})
+
+	// the entries of the same timestamp are replaced
+	Add("replaced")
+	c.Assert(Append("replaced", "AMD", Entries{at(0, "0"), at(1000, "1"), at(1000, "1b"), at(2000, "2")}), IsNil)
+	err = Append("replaced", "AMD", Entries{at(1000, "1c"), at(500, "0h"), at(2000, "2b")})
+	c.Assert(dropped(err), DeepEquals, []int{500})
+	expected = []string{"0", "1c", "2b"}
+	c.Assert(payloads(Get("replaced", "AMD", nil, nil, 0)), DeepEquals, expected)
+	p = masterCache.partition("replaced", "AMD")
+	c.Assert(p.bytes, Equals, entrySize(at(0, "0"))+2*entrySize(at(0, "1c")))
+
+	// an entry evicted from memory is replaced on disk
+	p.mu.Lock()
+	p.evictBytes(p.bytes)
+	p.mu.Unlock()
+	c.Assert(Append("replaced", "AMD", Entries{at(0, "0b")}), IsNil)
+	c.Assert(len(p.entries), Equals, 1)
+	// and only the entries of the timestamps on disk are replaced
+	p.mu.Lock()
+	p.evictBytes(p.bytes)
+	p.mu.Unlock()
+	err = Append("replaced", "AMD", Entries{at(1500, "1h"), at(1000, "1d")})
+	c.Assert(dropped(err), DeepEquals, []int{1500})
+	expected = []string{"0b", "1d", "2b"}
+	c.Assert(payloads(Get("replaced", "AMD", nil, nil, 0)), DeepEquals, expected)
+
+	// the entries are resolved on start
+	Build(dataDir)
+	Fill()
+	c.Assert(payloads(Get("late", "AMD", nil, nil, 0)), DeepEquals, []string{"0", "20", "25", "30", "31"})
+	c.Assert(payloads(Get("replaced", "AMD", nil, nil, 0)), DeepEquals, expected)
+}
+
+func (s *CacheTestSuite) TestDedup(c *C) {
+	defer func(config []utils.TopicPlan) {
+		utils.GlobalConfig.TopicConfig = config
+	}(utils.GlobalConfig.TopicConfig)
+	utils.GlobalConfig.TopicConfig = []utils.TopicPlan{
+		{TopicMatch: "^bars$", DedupWindow: 3},
+	}
+	dataDir := c.MkDir()
+	Build(dataDir)
+	Add("bars")
+	data := GenData()
+	for i, entry := range data {
+		entry.ID = fmt.Sprintf("msg-%d", i)
+	}
+	result, err := AppendResults("bars", "AMD", data[:3])
+	c.Assert(err, IsNil)
+	c.Assert(result.Accepted, Equals, 3)
+
+	// a retried batch is acknowledged without being appended again
+	result, err = AppendResults("bars", "AMD", data[:3])
+	c.Assert(err, IsNil)
+	c.Assert(result.Accepted, Equals, 0)
+	c.Assert(result.Duplicates, Equals, 3)
+	c.Assert(result.LastOffset, Equals, int64(2))
+	result, err = AppendResults("bars", "AMD", data[2:4])
+	c.Assert(err, IsNil)
+	c.Assert(result.Accepted, Equals, 1)
+	c.Assert(result.Duplicates, Equals, 1)
+	c.Assert(len(Get("bars", "AMD", nil, nil, 0)), Equals, 4)
+
+	// the duplicates in a batch are skipped too
+	dup := &Entry{Timestamp: data[4].Timestamp, Data: data[4].Data, ID: data[4].ID}
+	result, err = AppendResults("bars", "AMD", Entries{data[4], dup})
+	c.Assert(err, IsNil)
+	c.Assert(result.Duplicates, Equals, 1)
+
+	// the window survives restarts, and forgets the oldest IDs
+	Build(dataDir)
+	Fill()
+	results := Get("bars", "AMD", nil, nil, 0)
+	c.Assert(len(results), Equals, 5)
+	c.Assert(results[4].ID, Equals, "msg-4")
+	result, err = AppendResults("bars", "AMD", data[2:])
+	c.Assert(err, IsNil)
+	c.Assert(result.Duplicates, Equals, 3)
+	data[1].Timestamp = time.Now()
+	result, err = AppendResults("bars", "AMD", data[1:2])
+	c.Assert(err, IsNil)
+	c.Assert(result.Accepted, Equals, 1)
+}
+
+func (s *CacheTestSuite) TestAppendMulti(c *C) {
+	defer func(config []utils.TopicPlan) {
+		utils.GlobalConfig.TopicConfig = config
+	}(utils.GlobalConfig.TopicConfig)
+	utils.GlobalConfig.TopicConfig = []utils.TopicPlan{
+		{TopicMatch: "^trades$", OutOfOrder: OutOfOrderReject},
+	}
+	dataDir := c.MkDir()
+	Build(dataDir)
+	Add("quotes")
+	Add("trades")
+	data := GenData()
+
+	results, err := AppendMulti([]Write{
+		{Topic: "quotes", Partition: "AMD", Entries: data[:2]},
+		{Topic: "trades", Partition: "AMD", Entries: data[:2]},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(len(results), Equals, 2)
+	c.Assert(results[1].Accepted, Equals, 2)
+	c.Assert(results[1].LastOffset, Equals, int64(1))
+	// the publications come together
+	pubs := (<-Pull()).([]*Publication)
+	c.Assert(len(pubs), Equals, 2)
+	c.Assert(pubs[1].Topic, Equals, "trades")
+
+	_, err = AppendMulti([]Write{{Topic: "bars", Partition: "AMD", Entries: data[2:3]}})
+	c.Assert(err, Equals, ErrTopicNotFound)
+	_, err = AppendMulti([]Write{
+		{Topic: "quotes", Partition: "AMD", Entries: data[2:3]},
+		{Topic: "quotes", Partition: "AMD", Entries: data[3:4]},
+	})
+	c.Assert(err, Equals, ErrDuplicatePartition)
+
+	// nothing is appended if any of the writes is rejected
+	results, err = AppendMulti([]Write{
+		{Topic: "quotes", Partition: "AMD", Entries: data[2:3]},
+		{Topic: "trades", Partition: "AMD", Entries: data[:1]},
+	})
+	c.Assert(err, FitsTypeOf, &OutOfOrderError{})
+	c.Assert(results[1].Dropped, Equals, 1)
+	c.Assert(len(Get("quotes", "AMD", nil, nil, 0)), Equals, 2)
+	// and every write has its result
+	results, err = AppendMulti([]Write{
+		{Topic: "trades", Partition: "AMD", Entries: data[:1]},
+		{Topic: "quotes", Partition: "AMD", Entries: data[2:3]},
+	})
+	c.Assert(err, FitsTypeOf, &OutOfOrderError{})
+	c.Assert(results[0].Dropped, Equals, 1)
+	c.Assert(results[1], NotNil)
+	c.Assert(results[1].Accepted, Equals, 0)
+
+	// or fails to persist, with the written logs truncated back
+	c.Assert(Append("trades", "MSFT", data[:1]), IsNil)
+	msft := masterCache.partition("trades", "MSFT")
+	msft.clog.SetMaxSegmentBytes(1)
+	c.Assert(os.RemoveAll(msft.clog.Path), IsNil)
+	_, err = AppendMulti([]Write{
+		{Topic: "quotes", Partition: "AMD", Entries: data[2:4]},
+		{Topic: "trades", Partition: "MSFT", Entries: data[2:4]},
+	})
+	c.Assert(err, FitsTypeOf, &StorageError{})
+	amd := masterCache.partition("quotes", "AMD")
+	c.Assert(amd.clog.NextOffset(), Equals, int64(2))
+	c.Assert(len(Get("quotes", "AMD", nil, nil, 0)), Equals, 2)
+
+	Build(dataDir)
+	Fill()
+	c.Assert(len(Get("quotes", "AMD", nil, nil, 0)), Equals, 2)
+	results, err = AppendMulti([]Write{{Topic: "quotes", Partition: "AMD", Entries: data[2:4]}})
+	c.Assert(err, IsNil)
+	c.Assert(results[0].LastOffset, Equals, int64(3))
+}
+
+func (s *CacheTestSuite) TestAutoCreate(c *C) {
+	defer func(patterns []string) {
+		utils.GlobalConfig.AutoCreateTopics = patterns
+	}(utils.GlobalConfig.AutoCreateTopics)
+	utils.GlobalConfig.AutoCreateTopics = []string{"^bars"}
+	Build(c.MkDir())
+	data := GenData()
+
+	c.Assert(Append("quotes", "AMD", data[:1]), Equals, ErrTopicNotFound)
+	c.Assert(Append("bars", "AMD", data[:1]), IsNil)
+	c.Assert(len(Get("bars", "AMD", nil, nil, 0)), Equals, 1)
+	// the topic is announced before the partition
+	add := <-PullAdditions()
+	c.Assert(add.Topic, Equals, "bars")
+	c.Assert(add.Partition, Equals, "")
+	add = <-PullAdditions()
+	c.Assert(add.Partition, Equals, "AMD")
+
+	c.Assert(Ensure("bars_1m"), IsNil)
+	c.Assert(Ensure("bars_1m"), IsNil)
+	c.Assert(Ensure("quotes"), Equals, ErrTopicNotFound)
+	c.Assert((<-PullAdditions()).Topic, Equals, "bars_1m")
+
+	_, err := AppendMulti([]Write{
+		{Topic: "bars_5m", Partition: "AMD", Entries: data[:1]},
+		{Topic: "quotes", Partition: "AMD", Entries: data[:1]},
+	})
+	c.Assert(err, Equals, ErrTopicNotFound)
+
+	// nothing is created for a rejected batch
+	defer func(config []utils.TopicPlan) {
+		utils.GlobalConfig.TopicConfig = config
+	}(utils.GlobalConfig.TopicConfig)
+	utils.GlobalConfig.TopicConfig = []utils.TopicPlan{
+		{TopicMatch: "^bars_1m$", OutOfOrder: OutOfOrderReject},
+	}
+	c.Assert(Append("bars_1m", "AMD", data[1:2]), IsNil)
+	c.Assert((<-PullAdditions()).Partition, Equals, "AMD")
+	results, err := AppendMulti([]Write{
+		{Topic: "bars_5m", Partition: "AMD", Entries: data[:1]},
+		{Topic: "bars_1m", Partition: "AMD", Entries: data[:1]},
+	})
+	c.Assert(err, FitsTypeOf, &OutOfOrderError{})
+	c.Assert(results[0].Accepted, Equals, 0)
+	c.Assert(results[1].Dropped, Equals, 1)
+	c.Assert(Catalog()["bars_5m"], IsNil)
+	_, err = os.Stat(filepath.Join(masterCache.dataDir, "bars_5m"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	select {
+	case add := <-PullAdditions():
+		c.Fatalf("unexpected addition: %v", add)
+	default:
+	}
+
+	_, err = AppendMulti([]Write{{Topic: "bars_5m", Partition: "AMD", Entries: data[:1]}})
+	c.Assert(err, IsNil)
+	c.Assert(len(Get("bars_5m", "AMD", nil, nil, 0)), Equals, 1)
+	c.Assert((<-PullAdditions()).Topic, Equals, "bars_5m")
+	c.Assert((<-PullAdditions()).Partition, Equals, "AMD")
+}
+
+func (s *CacheTestSuite) TestNames(c *C) {
+	for _, topic := range []string{"", ".metadata", "..", "../bars", "bars/1m", "bars 1m", strings.Repeat("b", 256)} {
+		c.Assert(ValidateTopic(topic), FitsTypeOf, &NameError{})
+	}
+	c.Assert(ValidateTopic("bars_1m.v2"), IsNil)
+	c.Assert(ValidatePartition(""), FitsTypeOf, &NameError{})
+	c.Assert(ValidatePartition(strings.Repeat("/", 100)), FitsTypeOf, &NameError{})
+
+	for key, name := range map[string]string{
+		"AMD":       "AMD",
+		"BRK.B":     "BRK.B",
+		"ES/H24":    "ES%2FH24",
+		"..":        "%2E.",
+		".metadata": "%2Emetadata",
+		"100%":      "100%25",
+		"a b\\c":    "a%20b%5Cc",
+		"NVDA_bats": "NVDA_bats",
+		"été":       "%C3%A9t%C3%A9",
+	} {
+		c.Assert(EncodeKey(key), Equals, name)
+		decoded, err := DecodeKey(name)
+		c.Assert(err, IsNil)
+		c.Assert(decoded, Equals, key)
+	}
+	for _, name := range []string{"%", "%2", "%ZZ"} {
+		_, err := DecodeKey(name)
+		c.Assert(err, NotNil)
+	}
+	for name, key := range map[string]string{
+		"ES%2FH24": "ES/H24",
+		"AMD":      "AMD",
+		"A%41":     "A%41",
+		"^VIX":     "^VIX",
+		"100%":     "100%",
+	} {
+		c.Assert(KeyOfDir(name), Equals, key)
+	}
+
+	dataDir := c.MkDir()
+	Build(dataDir)
+	Add("futures")
+	c.Assert(Add("../futures"), FitsTypeOf, &NameError{})
+	c.Assert(Append("futures", "ES/H24", GenData()[:1]), IsNil)
+	c.Assert(Append("futures", "", GenData()[:1]), FitsTypeOf, &NameError{})
+	_, err := os.Stat(filepath.Join(dataDir, "futures", "ES%2FH24"))
+	c.Assert(err, IsNil)
+	Build(dataDir)
+	Fill()
+	c.Assert(len(Get("futures", "ES/H24", nil, nil, 0)), Equals, 1)
+}
+
+func (s *CacheTestSuite) TestPage(c *C) {
+	Build(c.MkDir())
+	Add("quotes")
+	// the entries of the same timestamp are paged in the order of offsets
+	now := time.Now().Round(time.Second)
+	data := Entries{}
+	for i := 0; i < 7; i++ {
+		data = append(data, &Entry{
+			Timestamp: now.Add(time.Duration(i/2) * time.Second),
+			Data:      []byte(fmt.Sprint(i)),
+		})
+	}
+	c.Assert(Append("quotes", "AMD", data), IsNil)
+
+	// forward
+	offsets := []int64{}
+	page, err := GetPage("quotes", "AMD", 0, nil, nil, "", 3, false)
+	c.Assert(err, IsNil)
+	c.Assert(page.Prev, Equals, "")
+	for {
+		c.Assert(len(page.Entries) <= 3, Equals, true)
+		for _, entry := range page.Entries {
+			offsets = append(offsets, entry.Offset)
+		}
+		if page.Next == "" {
+			break
+		}
+		next, err := GetPage("quotes", "AMD", 0, nil, nil, page.Next, 3, false)
+		c.Assert(err, IsNil)
+		c.Assert(next.Prev, Not(Equals), "")
+		page = next
+	}
+	c.Assert(offsets, DeepEquals, []int64{0, 1, 2, 3, 4, 5, 6})
+
+	// and back
+	page, err = GetPage("quotes", "AMD", 0, nil, nil, page.Prev, 3, false)
+	c.Assert(err, IsNil)
+	c.Assert(page.Entries[0].Offset, Equals, int64(3))
+	c.Assert(page.Entries[2].Offset, Equals, int64(5))
+	page, err = GetPage("quotes", "AMD", 0, nil, nil, page.Prev, 3, false)
+	c.Assert(err, IsNil)
+	c.Assert(len(page.Entries), Equals, 3)
+	c.Assert(page.Entries[0].Offset, Equals, int64(0))
+	c.Assert(page.Prev, Equals, "")
+	c.Assert(page.Next, Not(Equals), "")
+
+	// from the end within the range
+	to := now.Add(2 * time.Second)
+	page, err = GetPage("quotes", "AMD", 0, nil, &to, "", 4, true)
+	c.Assert(err, IsNil)
+	c.Assert(page.Entries[0].Offset, Equals, int64(2))
+	c.Assert(page.Entries[3].Offset, Equals, int64(5))
+	c.Assert(page.Next, Equals, "")
+	page, err = GetPage("quotes", "AMD", 0, nil, &to, page.Prev, 4, true)
+	c.Assert(err, IsNil)
+	c.Assert(len(page.Entries), Equals, 2)
+	c.Assert(page.Prev, Equals, "")
+
+	_, err = GetPage("quotes", "AMD", 0, nil, nil, "garbage", 3, false)
+	c.Assert(err, Equals, ErrInvalidCursor)
+	page, err = GetPage("quotes", "MSFT", 0, nil, nil, "", 3, false)
+	c.Assert(err, IsNil)
+	c.Assert(len(page.Entries), Equals, 0)
+
+	// the entries of the older formats have no offsets
+	partition := masterCache.partition("quotes", "AMD")
+	partition.mu.Lock()
+	for _, entry := range partition.entries {
+		entry.Offset = 0
+	}
+	partition.mu.Unlock()
+	values := []string{}
+	page, err = GetPage("quotes", "AMD", 0, nil, nil, "", 2, false)
+	c.Assert(err, IsNil)
+	for {
+		for _, entry := range page.Entries {
+			values = append(values, string(entry.Data))
+		}
+		if page.Next == "" {
+			break
+		}
+		page, err = GetPage("quotes", "AMD", 0, nil, nil, page.Next, 2, false)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(values, DeepEquals, []string{"0", "1", "2", "3", "4", "5", "6"})
+	values = values[:0]
+	page, err = GetPage("quotes", "AMD", 0, nil, nil, "", 2, true)
+	c.Assert(err, IsNil)
+	for {
+		for i := len(page.Entries) - 1; i >= 0; i-- {
+			values = append(values, string(page.Entries[i].Data))
+		}
+		if page.Prev == "" {
+			break
+		}
+		page, err = GetPage("quotes", "AMD", 0, nil, nil, page.Prev, 2, false)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(values, DeepEquals, []string{"6", "5", "4", "3", "2", "1", "0"})
+}
+
+func (s *CacheTestSuite) TestPageOnDisk(c *C) {
+	defer func(config []utils.TrimPlan) {
+		utils.GlobalConfig.TrimConfig = config
+	}(utils.GlobalConfig.TrimConfig)
+	utils.GlobalConfig.TrimConfig = []utils.TrimPlan{
+		{TopicMatch: "quotes", Duration: "720h", MemoryDuration: "1h"},
+	}
+	Build(c.MkDir())
+	Add("quotes")
+	// most of the entries are only on disk
+	now := time.Now().Round(time.Second)
+	data := Entries{}
+	for i := 0; i < 50; i++ {
+		data = append(data, &Entry{
+			Timestamp: now.Add(time.Duration(i-45) * 20 * time.Minute),
+			Data:      []byte(fmt.Sprint(i)),
+		})
+	}
+	c.Assert(Append("quotes", "AMD", data), IsNil)
+	Trim()
+	c.Assert(len(masterCache.partition("quotes", "AMD").entries), Equals, 8)
+
+	offsets := []int64{}
+	page, err := GetPage("quotes", "AMD", 0, nil, nil, "", 7, false)
+	c.Assert(err, IsNil)
+	for {
+		for _, entry := range page.Entries {
+			offsets = append(offsets, entry.Offset)
+		}
+		if page.Next == "" {
+			break
+		}
+		page, err = GetPage("quotes", "AMD", 0, nil, nil, page.Next, 7, false)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(offsets, HasLen, 50)
+	for i, offset := range offsets {
+		c.Assert(offset, Equals, int64(i))
+	}
+
+	offsets = offsets[:0]
+	page, err = GetPage("quotes", "AMD", 0, nil, nil, "", 7, true)
+	c.Assert(err, IsNil)
+	for {
+		c.Assert(len(page.Entries) <= 7, Equals, true)
+		for i := len(page.Entries) - 1; i >= 0; i-- {
+			offsets = append(offsets, page.Entries[i].Offset)
+		}
+		if page.Prev == "" {
+			break
+		}
+		page, err = GetPage("quotes", "AMD", 0, nil, nil, page.Prev, 7, false)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(offsets, HasLen, 50)
+	for i, offset := range offsets {
+		c.Assert(offset, Equals, int64(49-i))
+	}
+
+	// only the entries around the cursor are read
+	from := now.Add(-10 * time.Hour)
+	entries, err := masterCache.partition("quotes", "AMD").window(&from, nil, 0, 3, false)
+	c.Assert(err, IsNil)
+	c.Assert(len(entries) < 15, Equals, true)
+	to := now.Add(-10 * time.Hour)
+	entries, err = masterCache.partition("quotes", "AMD").window(nil, &to, 0, 3, true)
+	c.Assert(err, IsNil)
+	c.Assert(len(entries) < 20, Equals, true)
+	c.Assert(entries[len(entries)-1].Timestamp.Equal(to), Equals, true)
+}
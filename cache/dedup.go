@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"github.com/alpacahq/slait/utils/log"
+)
+
+// defaultDedupWindow is the number of the recent entry IDs kept per partition
+// to detect the retried writes.
+const defaultDedupWindow = 1000
+
+// dedupWindow is the set of the recent entry IDs of a partition, bounded by
+// the number of the IDs.
+type dedupWindow struct {
+	size int
+	ids  map[string]struct{}
+	// order is the IDs in the order added, to forget the oldest first
+	order []string
+}
+
+func newDedupWindow(size int, ids []string) *dedupWindow {
+	w := &dedupWindow{size: size}
+	w.reset()
+	for _, id := range ids {
+		w.add(id)
+	}
+	return w
+}
+
+func (w *dedupWindow) contains(id string) bool {
+	_, ok := w.ids[id]
+	return ok
+}
+
+func (w *dedupWindow) add(id string) {
+	if w.size <= 0 || w.contains(id) {
+		return
+	}
+	w.ids[id] = struct{}{}
+	w.order = append(w.order, id)
+	if len(w.order) > w.size {
+		delete(w.ids, w.order[0])
+		w.order = w.order[1:]
+	}
+}
+
+func (w *dedupWindow) reset() {
+	w.ids = map[string]struct{}{}
+	w.order = nil
+}
+
+// dedupWindowSize returns the number of the entry IDs to keep for the topic
+// from the first matching topic plan.  Unset is the default, and negative
+// disables the deduplication.
+func dedupWindowSize(topic string) int {
+	plan := topicPlan(topic)
+	if plan == nil || plan.DedupWindow == 0 {
+		return defaultDedupWindow
+	}
+	if plan.DedupWindow < 0 {
+		return 0
+	}
+	return plan.DedupWindow
+}
+
+// loadDedupWindow builds the dedup window of the partition from the IDs of
+// the last entries on disk, so that it survives restarts.  Only the segments
+// of the last size entries are read.
+func (p *Partition) loadDedupWindow(size int) {
+	ids, err := p.clog.LastIDs(size)
+	if err != nil {
+		log.Warning("Failed to read the entry IDs of %v: %v", p.clog.Path, err)
+	}
+	p.dedup = newDedupWindow(size, ids)
+}
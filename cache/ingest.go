@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/slait/commitlog"
+	"github.com/alpacahq/slait/utils/log"
+)
+
+// The policies for the entries older than the last one in the partition.
+const (
+	// OutOfOrderDrop discards them silently.  It is the default.
+	OutOfOrderDrop = "drop"
+	// OutOfOrderReject discards them and returns OutOfOrderError.
+	OutOfOrderReject = "reject"
+	// OutOfOrderLate inserts them in the timestamp order if they are within
+	// the lateness window from the last entry, and rejects the others.
+	OutOfOrderLate = "late"
+	// OutOfOrderReplace replaces the entries of the same timestamp with them,
+	// and rejects the ones with no entry to replace.
+	OutOfOrderReplace = "replace"
+)
+
+// The reasons for dropping an entry.
+const (
+	ReasonOutOfOrder = "older than the last entry"
+	ReasonTooLate    = "older than the lateness window"
+	ReasonNoMatch    = "no entry to replace"
+)
+
+// DroppedEntry is an entry not appended for the reason.
+type DroppedEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Reason    string    `json:"reason"`
+}
+
+// AppendResult is the result of appending entries to a partition.
+// Duplicates is the number of the entries skipped since their IDs have been
+// appended already.  LastTimestamp is the latest timestamp in the partition
+// after the append, and LastOffset is the offset of the last entry appended to
+// it, or -1 if none.
+type AppendResult struct {
+	Accepted       int            `json:"accepted"`
+	Duplicates     int            `json:"duplicates"`
+	Dropped        int            `json:"dropped"`
+	DroppedEntries []DroppedEntry `json:"dropped_entries,omitempty"`
+	LastTimestamp  time.Time      `json:"last_timestamp"`
+	LastOffset     int64          `json:"last_offset"`
+	// appended is the entries to publish
+	appended Entries
+}
+
+// OutOfOrderError is returned when some of the entries are rejected for being
+// out of order.  The other entries are appended.
+type OutOfOrderError struct {
+	Dropped []DroppedEntry
+}
+
+func (e *OutOfOrderError) Error() string {
+	timestamps := make([]string, len(e.Dropped))
+	for i, entry := range e.Dropped {
+		timestamps[i] = fmt.Sprintf("%s (%s)", entry.Timestamp.Format(time.RFC3339Nano), entry.Reason)
+	}
+	return fmt.Sprintf("%d entries out of order dropped: %s", len(e.Dropped), strings.Join(timestamps, ", "))
+}
+
+// ingestPolicy returns the out-of-order policy and the lateness window of the
+// topic from the first matching topic plan.
+func ingestPolicy(topic string) (string, time.Duration) {
+	plan := topicPlan(topic)
+	if plan == nil {
+		return OutOfOrderDrop, 0
+	}
+	policy := plan.OutOfOrder
+	switch policy {
+	case OutOfOrderDrop, OutOfOrderReject, OutOfOrderLate, OutOfOrderReplace:
+	case "":
+		policy = OutOfOrderDrop
+	default:
+		log.Warning("Invalid out_of_order for %s: %s", topic, policy)
+		policy = OutOfOrderDrop
+	}
+	if plan.Lateness == "" {
+		return policy, 0
+	}
+	lateness, err := time.ParseDuration(plan.Lateness)
+	if err != nil {
+		log.Warning("Parsing lateness failed for %s: %s, %v", topic, plan.Lateness, err)
+		return policy, 0
+	}
+	return policy, lateness
+}
+
+// ordered returns true if the entries of the partition are appended only in
+// the timestamp order, so that their offsets are in the same order.
+func (p *Partition) ordered() bool {
+	return p.outOfOrder != OutOfOrderLate && p.outOfOrder != OutOfOrderReplace
+}
+
+// readLateness returns how far past a range to read the log for the late
+// entries in the range.
+func (p *Partition) readLateness() time.Duration {
+	switch p.outOfOrder {
+	case OutOfOrderLate:
+		return p.lateness
+	case OutOfOrderReplace:
+		// an entry of any age may be replaced
+		return -1
+	}
+	return 0
+}
+
+// put inserts the entry after the entries of the same or older timestamps.  If
+// replace is true, the entries of the same timestamp are removed and returned.
+// The entries are modified in place.
+func (e Entries) put(entry *Entry, replace bool) (Entries, Entries) {
+	end := sort.Search(len(e), func(i int) bool {
+		return e[i].Timestamp.After(entry.Timestamp)
+	})
+	if end == len(e) && !replace {
+		return append(e, entry), nil
+	}
+	start := end
+	if replace {
+		start = sort.Search(end, func(i int) bool {
+			return !e[i].Timestamp.Before(entry.Timestamp)
+		})
+	}
+	removed := append(Entries{}, e[start:end]...)
+	rest := append(Entries{entry}, e[end:]...)
+	return append(e[:start], rest...), removed
+}
+
+// ReadEntries reads the rest of the entries from the reader and returns them
+// in the timestamp order, with the late entries inserted and the replaced ones
+// removed.
+func ReadEntries(reader *commitlog.Reader) (Entries, error) {
+	entries := Entries{}
+	for {
+		entry, err := reader.Read()
+		if err != nil {
+			return nil, err
+		} else if entry == nil {
+			return entries, nil
+		}
+		entries, _ = entries.put(&Entry{
+			Timestamp: entry.Timestamp,
+			Data:      entry.Data,
+			Offset:    entry.Offset,
+			ID:        entry.ID,
+		}, entry.Replace)
+	}
+}
+
+// since returns the entries at or after offset.
+func (e Entries) since(offset int64) Entries {
+	entries := Entries{}
+	for _, entry := range e {
+		if entry.Offset >= offset {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
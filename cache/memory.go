@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+
+	"github.com/alpacahq/slait/utils"
+	"github.com/alpacahq/slait/utils/log"
+)
+
+// entryOverhead approximates the memory used by an entry besides its data and
+// ID: the pointer in the slice, the timestamp and the slice header of the data.
+const entryOverhead = 8 + 24 + 24
+
+func entrySize(e *Entry) int64 {
+	return entryOverhead + int64(len(e.Data)) + int64(len(e.ID))
+}
+
+// PartitionUsage is the memory usage of a partition.
+type PartitionUsage struct {
+	Bytes   int64     `json:"bytes"`
+	Entries int       `json:"entries"`
+	MemFrom time.Time `json:"mem_from"`
+}
+
+// TopicUsage is the memory usage of a topic.  Limit is 0 if there is none.
+type TopicUsage struct {
+	Bytes      int64                     `json:"bytes"`
+	Limit      int64                     `json:"limit"`
+	Partitions map[string]PartitionUsage `json:"partitions"`
+}
+
+// Usage is the memory usage of the cache.  Limit is 0 if there is none.
+type Usage struct {
+	Bytes  int64                 `json:"bytes"`
+	Limit  int64                 `json:"limit"`
+	Topics map[string]TopicUsage `json:"topics"`
+}
+
+// touch records the access to the partition for the eviction.
+func (p *Partition) touch() {
+	atomic.StoreInt64(&p.lastAccess, time.Now().UnixNano())
+}
+
+// drop removes the first n entries from memory.  The caller must hold the lock.
+func (p *Partition) drop(n int) {
+	if n <= 0 {
+		return
+	}
+	for _, e := range p.entries[:n] {
+		p.bytes -= entrySize(e)
+	}
+	// free the memory
+	e := make(Entries, len(p.entries[n:]))
+	copy(e, p.entries[n:])
+	p.entries = e
+}
+
+// evictBytes drops the oldest entries from memory to free up to size bytes,
+// leaving them on disk.  The last entry is kept to check the order of the new
+// entries.  Returns the number of bytes freed.  The caller must hold the lock.
+func (p *Partition) evictBytes(size int64) int64 {
+	freed := int64(0)
+	n := 0
+	for ; n < len(p.entries)-1 && freed < size; n++ {
+		freed += entrySize(p.entries[n])
+	}
+	// the entries of the same timestamp are evicted together, so that the
+	// entries before memFrom are all on disk
+	for n > 0 && n < len(p.entries) && p.entries[n-1].Timestamp.Equal(p.entries[n].Timestamp) {
+		n--
+		freed -= entrySize(p.entries[n])
+	}
+	if n == 0 {
+		return 0
+	}
+	p.memFrom = p.entries[n].Timestamp
+	p.drop(n)
+	return freed
+}
+
+func (p *Partition) usage() PartitionUsage {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return PartitionUsage{
+		Bytes:   p.bytes,
+		Entries: len(p.entries),
+		MemFrom: p.memFrom,
+	}
+}
+
+// memoryLimit returns the memory limit of the topic from the first matching
+// trim plan, or 0 if there is none.
+func memoryLimit(topic string) int64 {
+	plan := trimPlan(topic)
+	if plan == nil {
+		return 0
+	}
+	return parseLimit(plan.MemoryLimit)
+}
+
+func parseLimit(limit string) int64 {
+	if limit == "" {
+		return 0
+	}
+	size, err := bytefmt.ToBytes(limit)
+	if err != nil {
+		log.Warning("Parsing memory_limit failed: %s, %v", limit, err)
+		return 0
+	}
+	return int64(size)
+}
+
+func (c *Cache) usage() Usage {
+	usage := Usage{
+		Limit:  parseLimit(utils.GlobalConfig.MemoryLimit),
+		Topics: map[string]TopicUsage{},
+	}
+	c.topics.Range(func(key, value interface{}) bool {
+		topic := key.(string)
+		tu := TopicUsage{
+			Limit:      memoryLimit(topic),
+			Partitions: map[string]PartitionUsage{},
+		}
+		value.(*Topic).partitions.Range(func(pkey, pvalue interface{}) bool {
+			pu := pvalue.(*Partition).usage()
+			tu.Partitions[pkey.(string)] = pu
+			tu.Bytes += pu.Bytes
+			return true
+		})
+		usage.Topics[topic] = tu
+		usage.Bytes += tu.Bytes
+		return true
+	})
+	return usage
+}
+
+// enforceLimits evicts the entries from memory until the usage of each topic
+// and the whole cache are within their limits.  The least recently accessed
+// partitions are evicted first, so the idle partitions are evicted as a whole
+// before the active ones lose their oldest entries.  Returns the number of
+// bytes evicted.
+func (c *Cache) enforceLimits() int64 {
+	usage := c.usage()
+	evicted := int64(0)
+	for topic, tu := range usage.Topics {
+		if tu.Limit > 0 && tu.Bytes > tu.Limit {
+			freed := c.evict(c.topicPartitions(topic), tu.Bytes-tu.Limit)
+			evicted += freed
+			usage.Bytes -= freed
+		}
+	}
+	if usage.Limit > 0 && usage.Bytes > usage.Limit {
+		partitions := []*Partition{}
+		c.topics.Range(func(key, value interface{}) bool {
+			partitions = append(partitions, c.topicPartitions(key.(string))...)
+			return true
+		})
+		evicted += c.evict(partitions, usage.Bytes-usage.Limit)
+	}
+	return evicted
+}
+
+func (c *Cache) topicPartitions(topic string) []*Partition {
+	partitions := []*Partition{}
+	if t, ok := c.topics.Load(topic); ok {
+		t.(*Topic).partitions.Range(func(key, value interface{}) bool {
+			partitions = append(partitions, value.(*Partition))
+			return true
+		})
+	}
+	return partitions
+}
+
+// evict frees size bytes from the partitions, starting from the least
+// recently accessed one.
+func (c *Cache) evict(partitions []*Partition, size int64) int64 {
+	sort.Slice(partitions, func(i, j int) bool {
+		return atomic.LoadInt64(&partitions[i].lastAccess) < atomic.LoadInt64(&partitions[j].lastAccess)
+	})
+	freed := int64(0)
+	for _, p := range partitions {
+		if freed >= size {
+			break
+		}
+		p.mu.Lock()
+		freed += p.evictBytes(size - freed)
+		p.mu.Unlock()
+	}
+	return freed
+}
+
+// MemoryUsage returns the memory usage of the cache.
+func MemoryUsage() Usage {
+	return masterCache.usage()
+}
@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+
+	"github.com/alpacahq/slait/commitlog"
+)
+
+// MetadataFile is the name of the topic metadata file in the topic directory.
+// It starts with a dot so that it is not taken for a partition.
+const MetadataFile = ".metadata.json"
+
+// metadataTmpFile is the metadata being written, which is left behind if the
+// write is interrupted.
+const metadataTmpFile = MetadataFile + ".tmp"
+
+// Retention is the retention policy of a topic.  The entries are deleted if
+// any of the limits is exceeded.
+type Retention struct {
+	Duration   string `json:"duration,omitempty"`
+	MaxBytes   string `json:"max_bytes,omitempty"`
+	MaxEntries int64  `json:"max_entries,omitempty"`
+}
+
+// Metadata is the user-defined settings of a topic.  Retention and
+// SegmentBytes override the configuration of the topic if they are set.
+type Metadata struct {
+	Description  string            `json:"description,omitempty"`
+	Retention    *Retention        `json:"retention,omitempty"`
+	SegmentBytes string            `json:"segment_bytes,omitempty"`
+	Schema       json.RawMessage   `json:"schema,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// cleanerOptions returns the cleaner options of the retention policy.  The
+// default is 120h.  The invalid values are skipped with the error returned.
+func (r *Retention) cleanerOptions() (commitlog.CleanerOptions, error) {
+	opts := commitlog.CleanerOptions{}
+	policies := []string{}
+	var err error
+	if r.Duration != "" {
+		if _, e := time.ParseDuration(r.Duration); e != nil {
+			err = fmt.Errorf("invalid duration %s: %v", r.Duration, e)
+		} else {
+			opts["Duration"] = r.Duration
+			policies = append(policies, "Duration")
+		}
+	}
+	if r.MaxBytes != "" {
+		if maxBytes, e := bytefmt.ToBytes(r.MaxBytes); e != nil {
+			err = fmt.Errorf("invalid max_bytes %s: %v", r.MaxBytes, e)
+		} else {
+			opts["MaxLogBytes"] = fmt.Sprint(maxBytes)
+			policies = append(policies, "ByteSize")
+		}
+	}
+	if r.MaxEntries > 0 {
+		opts["MaxEntries"] = fmt.Sprint(r.MaxEntries)
+		policies = append(policies, "EntryCount")
+	}
+	switch len(policies) {
+	case 0:
+		opts["Name"] = "Duration"
+		opts["Duration"] = "120h"
+	case 1:
+		opts["Name"] = policies[0]
+	default:
+		opts["Name"] = "Composite"
+	}
+	return opts, err
+}
+
+// apply overrides the commitlog options with the metadata.
+func (m *Metadata) apply(opts *commitlog.Options) error {
+	if m.Retention != nil {
+		cleanerOpts, err := m.Retention.cleanerOptions()
+		if err != nil {
+			return err
+		}
+		opts.CleanerOptions = cleanerOpts
+	}
+	if m.SegmentBytes != "" {
+		maxBytes, err := bytefmt.ToBytes(m.SegmentBytes)
+		if err != nil {
+			return fmt.Errorf("invalid segment_bytes %s: %v", m.SegmentBytes, err)
+		}
+		opts.MaxSegmentBytes = int64(maxBytes)
+	}
+	return nil
+}
+
+// ReadMetadata reads the metadata of the topic under dataDir.  Returns nil if
+// the topic has no metadata.
+func ReadMetadata(dataDir, topic string) (*Metadata, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, topic, MetadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	meta := &Metadata{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata of %s: %v", topic, err)
+	}
+	return meta, nil
+}
+
+// writeMetadata replaces the metadata file of the topic atomically.
+func writeMetadata(dataDir, topic string, meta *Metadata) error {
+	dir := filepath.Join(dataDir, topic)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, metadataTmpFile)
+	if err := ioutil.WriteFile(tmpPath, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, MetadataFile))
+}
+
+func (c *Cache) getMetadata(topic string) (*Metadata, error) {
+	t, ok := c.topics.Load(topic)
+	if !ok {
+		return nil, ErrTopicNotFound
+	}
+	top := t.(*Topic)
+	top.mu.RLock()
+	defer top.mu.RUnlock()
+	if top.meta == nil {
+		return &Metadata{}, nil
+	}
+	return top.meta, nil
+}
+
+// setMetadata persists the metadata of the topic and applies the retention
+// policy and the segment size to its partitions.
+func (c *Cache) setMetadata(topic string, meta *Metadata) error {
+	t, ok := c.topics.Load(topic)
+	if !ok {
+		return ErrTopicNotFound
+	}
+	top := t.(*Topic)
+	// validate before writing
+	opts := commitlog.Options{}
+	if err := meta.apply(&opts); err != nil {
+		return err
+	}
+	top.mu.Lock()
+	defer top.mu.Unlock()
+	if err := writeMetadata(c.dataDir, topic, meta); err != nil {
+		return err
+	}
+	top.meta = meta
+
+	var err error
+	top.partitions.Range(func(key, value interface{}) bool {
+		opts, e := LogOptions(c.dataDir, topic, key.(string))
+		if e != nil {
+			err = e
+			return false
+		}
+		p := value.(*Partition)
+		p.mu.Lock()
+		p.clog.SetCleanerOptions(opts.CleanerOptions)
+		p.clog.SetMaxSegmentBytes(opts.MaxSegmentBytes)
+		p.mu.Unlock()
+		return true
+	})
+	return err
+}
+
+// GetMetadata returns the metadata of the topic.
+func GetMetadata(topic string) (*Metadata, error) {
+	return masterCache.getMetadata(topic)
+}
+
+// SetMetadata replaces the metadata of the topic.  The changes of the
+// retention policy and the segment size take effect immediately.
+func SetMetadata(topic string, meta *Metadata) error {
+	return masterCache.setMetadata(topic, meta)
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxNameBytes is the maximum length of a file name on most filesystems.
+const maxNameBytes = 255
+
+// topicPattern is the names allowed for topics.  A leading dot is reserved
+// for the files in the data directory such as the metadata.
+var topicPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// NameError is returned for a topic or partition name that is not allowed.
+type NameError struct {
+	Kind   string
+	Name   string
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("Invalid %s name %q: %s", e.Kind, e.Name, e.Reason)
+}
+
+// ValidateTopic returns NameError if the topic name is not allowed.  The topic
+// is a directory in the data directory as is, so it is limited to letters,
+// digits, '_', '-' and '.' not at the start.
+func ValidateTopic(topic string) error {
+	switch {
+	case topic == "":
+		return &NameError{"topic", topic, "empty"}
+	case len(topic) > maxNameBytes:
+		return &NameError{"topic", topic, fmt.Sprintf("longer than %d bytes", maxNameBytes)}
+	case !topicPattern.MatchString(topic):
+		return &NameError{"topic", topic, "only letters, digits, '_', '-' and '.' not at the start are allowed"}
+	}
+	return nil
+}
+
+// ValidatePartition returns NameError if the partition key is not allowed.  Any
+// key is allowed as long as it is not empty and not too long once encoded.
+func ValidatePartition(key string) error {
+	switch {
+	case key == "":
+		return &NameError{"partition", key, "empty"}
+	case len(EncodeKey(key)) > maxNameBytes:
+		return &NameError{"partition", key, fmt.Sprintf("longer than %d bytes on disk", maxNameBytes)}
+	}
+	return nil
+}
+
+// EncodeKey returns the directory name of the partition key.  The bytes other
+// than letters, digits, '_', '-' and '.' not at the start are escaped as %XX,
+// so that the common keys such as "AMD" and "BRK.B" are unchanged and the
+// others such as "ES/H24" cannot escape the topic directory.
+func EncodeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '_' || c == '-' || c == '.' && i > 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// DecodeKey returns the partition key of the directory name made by EncodeKey.
+func DecodeKey(name string) (string, error) {
+	if !strings.Contains(name, "%") {
+		return name, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("invalid partition directory: %s", name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid partition directory: %s", name)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// KeyOfDir returns the partition key of the directory name.  A name made by
+// EncodeKey is decoded, and any other name is the key as is, since it was made
+// before the keys were escaped on disk, e.g. "A%41" is not decoded to "AA".
+func KeyOfDir(name string) string {
+	if key, err := DecodeKey(name); err == nil && EncodeKey(key) == name {
+		return key
+	}
+	return name
+}
+
+// PartitionPath returns the directory of the partition under dataDir.
+func PartitionPath(dataDir, topic, key string) string {
+	return filepath.Join(dataDir, topic, EncodeKey(key))
+}
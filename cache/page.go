@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned for a cursor not made by GetPage.
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Page is a page of the entries in a partition.  Next and Prev are the cursors
+// to the following and the preceding pages, or empty if there is none.
+type Page struct {
+	Entries Entries
+	Next    string
+	Prev    string
+}
+
+// position is where a cursor points to, just after or before the entry of the
+// timestamp and the offset.  The entries in a partition are in the order of
+// their timestamps and then their offsets, so that a position is stable among
+// the entries of the same timestamp.  The entries of the older formats have no
+// offsets, so rank tells the ones of the same timestamp and offset apart by
+// their order.
+type position struct {
+	after     bool
+	timestamp time.Time
+	offset    int64
+	rank      int
+}
+
+// cursor encodes the position opaquely.
+func (pos position) cursor() string {
+	dir := 'b'
+	if pos.after {
+		dir = 'a'
+	}
+	s := fmt.Sprintf("%c%d.%d.%d", dir, pos.timestamp.UnixNano(), pos.offset, pos.rank)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// parseCursor returns the position of the cursor, or nil if it is empty.
+func parseCursor(cursor string) (*position, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(data) == 0 {
+		return nil, ErrInvalidCursor
+	}
+	var nano, offset int64
+	var rank int
+	fields := strings.Split(string(data[1:]), ".")
+	switch len(fields) {
+	case 3:
+		if rank, err = strconv.Atoi(fields[2]); err != nil || rank < 0 {
+			return nil, ErrInvalidCursor
+		}
+		fallthrough
+	case 2:
+		// the cursors made before rank was added
+		nano, err = strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		if offset, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	default:
+		return nil, ErrInvalidCursor
+	}
+	pos := &position{timestamp: time.Unix(0, nano), offset: offset, rank: rank}
+	switch data[0] {
+	case 'a':
+		pos.after = true
+	case 'b':
+	default:
+		return nil, ErrInvalidCursor
+	}
+	return pos, nil
+}
+
+// at returns the position after or before entries[i].
+func at(entries Entries, i int, after bool) position {
+	entry := entries[i]
+	rank := 0
+	for j := i - 1; j >= 0 && entries[j].Timestamp.Equal(entry.Timestamp) && entries[j].Offset == entry.Offset; j-- {
+		rank++
+	}
+	return position{after: after, timestamp: entry.Timestamp, offset: entry.Offset, rank: rank}
+}
+
+// index returns the index of the first entry after the position if it is
+// after, or of the first entry not before the position otherwise.
+func (pos *position) index(entries Entries) int {
+	// the entries in [i, j) have the timestamp and the offset of the position
+	i := sort.Search(len(entries), func(i int) bool {
+		e := entries[i]
+		return e.Timestamp.After(pos.timestamp) || (e.Timestamp.Equal(pos.timestamp) && e.Offset >= pos.offset)
+	})
+	j := sort.Search(len(entries), func(j int) bool {
+		e := entries[j]
+		return e.Timestamp.After(pos.timestamp) || (e.Timestamp.Equal(pos.timestamp) && e.Offset > pos.offset)
+	})
+	k := i + pos.rank
+	if pos.after {
+		k++
+	}
+	if k > j {
+		k = j
+	}
+	return k
+}
+
+// getPage returns up to limit entries qualified by from and to, at or after
+// offset, next to the cursor.  Without a cursor, the page is the first entries,
+// or the last ones if fromEnd is true.  Only the entries around the cursor are
+// read from disk.
+func (c *Cache) getPage(topic, key string, offset int64, from, to *time.Time, cursor string, limit int, fromEnd bool) (*Page, error) {
+	pos, err := parseCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	partition := c.partition(topic, key)
+	if partition == nil {
+		return &Page{}, nil
+	}
+	// read no further than the cursor
+	if pos != nil && pos.after && (from == nil || from.Before(pos.timestamp)) {
+		from = &pos.timestamp
+	} else if pos != nil && !pos.after && (to == nil || to.After(pos.timestamp)) {
+		to = &pos.timestamp
+	}
+	backward := (pos != nil && !pos.after) || (pos == nil && fromEnd)
+	entries, err := partition.window(from, to, offset, limit, backward)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := 0, len(entries)
+	switch {
+	case pos != nil && pos.after:
+		start = pos.index(entries)
+		if start+limit < end {
+			end = start + limit
+		}
+	case pos != nil:
+		end = pos.index(entries)
+		if end-limit > start {
+			start = end - limit
+		}
+	case fromEnd:
+		if end-limit > start {
+			start = end - limit
+		}
+	default:
+		if limit < end {
+			end = limit
+		}
+	}
+
+	page := &Page{Entries: entries[start:end]}
+	if len(page.Entries) == 0 {
+		return page, nil
+	}
+	// the entries beyond the cursor are not read, but there is at least the
+	// one the cursor was made from
+	if end < len(entries) || (pos != nil && !pos.after) {
+		page.Next = at(entries, end-1, true).cursor()
+	}
+	if start > 0 || (pos != nil && pos.after) {
+		page.Prev = at(entries, start, false).cursor()
+	}
+	return page, nil
+}
+
+// window returns the entries qualified by from and to, at or after offset, that
+// include the first limit ones after from, or the last limit ones before to if
+// backward is true, and one more if any.  The entries on disk are read only as
+// far as needed.
+func (p *Partition) window(from, to *time.Time, offset int64, limit int, backward bool) (Entries, error) {
+	entries, diskTo := p.memSlice(from, to, offset)
+	if diskTo == nil {
+		return entries, nil
+	}
+	// one more entry tells if there is another page
+	limit++
+	var (
+		older Entries
+		err   error
+	)
+	if backward {
+		// the entries at to may be after the cursor
+		n := sort.Search(len(entries), func(i int) bool {
+			return to != nil && !entries[i].Timestamp.Before(*to)
+		})
+		if n >= limit {
+			return entries, nil
+		}
+		older, err = p.readDiskLast(from, *diskTo, offset, limit-n)
+	} else {
+		older, err = p.readDiskFirst(from, diskTo, offset, limit)
+	}
+	if err != nil {
+		return nil, &StorageError{err}
+	}
+	return append(older, entries...), nil
+}
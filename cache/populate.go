@@ -1,8 +1,11 @@
 package cache
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/alpacahq/slait/commitlog"
 	"github.com/alpacahq/slait/utils/log"
@@ -12,13 +15,23 @@ func (c *Cache) fill() error {
 	rootDir := c.dataDir
 	finfos, err := ioutil.ReadDir(rootDir)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
 	for _, finfo := range finfos {
 		tname := finfo.Name()
-		c.addTopic(tname)
+		if !finfo.IsDir() {
+			log.Warning("Skipping %s in the data directory: not a topic directory", tname)
+			continue
+		}
+		// the data of a topic is not left out silently
+		if err := c.addTopic(tname); err != nil {
+			return fmt.Errorf("failed to load %s: %v, rename or remove the directory", filepath.Join(rootDir, tname), err)
+		}
 		if err := c.fillTopic(tname, filepath.Join(rootDir, tname)); err != nil {
-			log.Error("%v", err)
+			return err
 		}
 	}
 	return nil
@@ -30,35 +43,81 @@ func (c *Cache) fillTopic(tname, topicDir string) error {
 		return err
 	}
 	for _, finfo := range finfos {
-		pname := finfo.Name()
+		switch {
+		case finfo.Name() == MetadataFile:
+			continue
+		case finfo.Name() == metadataTmpFile:
+			// the previous metadata is still in place
+			if err := os.Remove(filepath.Join(topicDir, finfo.Name())); err != nil {
+				log.Warning("Failed to remove %s: %v", filepath.Join(topicDir, finfo.Name()), err)
+			}
+			continue
+		case !finfo.IsDir():
+			log.Warning("Skipping %s in the topic directory: not a partition directory", filepath.Join(topicDir, finfo.Name()))
+			continue
+		}
+		pname, err := MigrateKeyDir(topicDir, finfo.Name())
+		if err != nil {
+			return err
+		}
 		c.updateTopic(tname, pname, AddPartition)
-		if err := c.fillPartition(tname, pname, filepath.Join(topicDir, pname)); err != nil {
+		if err := c.fillPartition(tname, pname, filepath.Join(topicDir, EncodeKey(pname))); err != nil {
 			log.Error("failed to fill partition: %v (%s/%s)", err, tname, pname)
 		}
 	}
 	return nil
 }
 
+// MigrateKeyDir returns the partition key of the directory named name in
+// topicDir, which is renamed to the escaped key if it was made before the keys
+// were escaped on disk.
+func MigrateKeyDir(topicDir, name string) (string, error) {
+	key := KeyOfDir(name)
+	if EncodeKey(key) == name {
+		return key, nil
+	}
+	oldPath := filepath.Join(topicDir, name)
+	newPath := filepath.Join(topicDir, EncodeKey(key))
+	if _, err := os.Stat(newPath); err == nil {
+		return "", fmt.Errorf("failed to rename %s to %s: both exist, merge or remove one of them", oldPath, newPath)
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return "", fmt.Errorf("failed to rename %s to %s: %v", oldPath, newPath, err)
+	}
+	log.Info("Renamed %s to %s for the partition %q", oldPath, newPath, key)
+	return key, nil
+}
+
 func (c *Cache) fillPartition(tname, pname, path string) error {
-	reader, err := commitlog.NewReader(path)
+	var reader *commitlog.Reader
+	var err error
+	if p := c.partition(tname, pname); p != nil && p.memRetention > 0 {
+		// leave the older entries on disk, but keep the last one in memory
+		// to check the order of the new entries
+		p.memFrom = time.Now().Add(-p.memRetention)
+		var last time.Time
+		last, err = p.clog.LastTimestamp()
+		if err != nil {
+			return err
+		}
+		if !last.IsZero() && last.Before(p.memFrom) {
+			p.memFrom = last
+		}
+		reader, err = commitlog.NewReaderFrom(path, p.memFrom)
+	} else {
+		reader, err = commitlog.NewReader(path)
+	}
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
-	entries := Entries{}
-	for {
-		entry, err := reader.Read()
-		if entry == nil && err == nil {
-			break
-		} else if err != nil {
-			return err
-		}
-		entries = append(entries, &Entry{
-			entry.Timestamp, entry.Data,
-		})
+	entries, err := ReadEntries(reader)
+	if err != nil {
+		return err
 	}
 	if len(entries) > 0 {
-		return c.appendEntries(tname, pname, entries, false)
+		_, err := c.appendEntries(tname, pname, entries, false)
+		return err
 	} else {
 		return nil
 	}
@@ -1,9 +1,13 @@
 package cache
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/alpacahq/slait/commitlog"
 	. "gopkg.in/check.v1"
 )
 
@@ -11,25 +15,29 @@ func getFillTestData() Entries {
 	t11 := time.Date(2017, 8, 21, 14, 15, 32, 95589, time.UTC)
 	data11 := []byte(t11.Format(time.RFC3339))
 	entry11 := &Entry{
-		t11, data11,
+		Timestamp: t11,
+		Data:      data11,
 	}
 
 	t12 := time.Date(2017, 8, 21, 14, 17, 3, 3198, time.UTC)
 	data12 := []byte(t12.Format(time.RFC3339))
 	entry12 := &Entry{
-		t12, data12,
+		Timestamp: t12,
+		Data:      data12,
 	}
 
 	t21 := time.Date(2017, 8, 21, 13, 35, 2, 589, time.UTC)
 	data21 := []byte(t21.Format(time.RFC3339))
 	entry21 := &Entry{
-		t21, data21,
+		Timestamp: t21,
+		Data:      data21,
 	}
 
 	t22 := time.Date(2017, 8, 21, 15, 43, 19, 8313198, time.UTC)
 	data22 := []byte(t12.Format(time.RFC3339))
 	entry22 := &Entry{
-		t22, data22,
+		Timestamp: t22,
+		Data:      data22,
 	}
 
 	return Entries{
@@ -61,11 +69,70 @@ func (s *CacheTestSuite) TestFill(c *C) {
 		c.Fatal(err)
 	}
 
-	entries1 := cache2.get("topic1", "part1", nil, nil, 0)
+	entries1 := cache2.get("topic1", "part1", nil, nil, 0, 0)
 	c.Assert(len(entries1), Equals, 2)
 	c.Assert(entries1[0].Timestamp, Equals, entries[0].Timestamp)
 
-	entries2 := cache2.get("topic2", "abc", nil, nil, 0)
+	entries2 := cache2.get("topic2", "abc", nil, nil, 0, 0)
 	c.Assert(len(entries2), Equals, 2)
 	c.Assert(string(entries2[1].Data), Equals, string(entries[3].Data))
+
+	// the metadata left half-written is not a partition
+	tmpPath := filepath.Join(dataDir, "topic1", metadataTmpFile)
+	c.Assert(ioutil.WriteFile(tmpPath, []byte("{"), 0666), IsNil)
+	cache3 := &Cache{topics: &sync.Map{}, dataDir: dataDir}
+	c.Assert(cache3.fill(), IsNil)
+	t, _ := cache3.topics.Load("topic1")
+	_, ok := t.(*Topic).partitions.Load(metadataTmpFile)
+	c.Assert(ok, Equals, false)
+	c.Assert(len(cache3.get("topic1", "part1", nil, nil, 0, 0)), Equals, 2)
+	finfos, err := ioutil.ReadDir(filepath.Join(dataDir, "topic1"))
+	c.Assert(err, IsNil)
+	c.Assert(len(finfos), Equals, 1)
+	c.Assert(finfos[0].Name(), Equals, "part1")
+}
+
+func (s *CacheTestSuite) TestFillLegacyNames(c *C) {
+	dataDir := c.MkDir()
+	entries := getFillTestData()
+	// the partition directories made before the keys were escaped
+	for _, key := range []string{"^VIX", "100%", "A%41"} {
+		clog, err := commitlog.New(commitlog.Options{Path: filepath.Join(dataDir, "indices", key)})
+		c.Assert(err, IsNil)
+		c.Assert(clog.AppendBatch([]*commitlog.Entry{
+			{Timestamp: entries[0].Timestamp, Data: entries[0].Data},
+		}), IsNil)
+		clog.Close()
+	}
+
+	cache1 := &Cache{topics: &sync.Map{}, dataDir: dataDir}
+	c.Assert(cache1.fill(), IsNil)
+	for _, name := range []string{"%5EVIX", "100%25", "A%2541"} {
+		_, err := os.Stat(filepath.Join(dataDir, "indices", name))
+		c.Assert(err, IsNil)
+	}
+	_, err := os.Stat(filepath.Join(dataDir, "indices", "^VIX"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(len(cache1.get("indices", "^VIX", nil, nil, 0, 0)), Equals, 1)
+	c.Assert(len(cache1.get("indices", "100%", nil, nil, 0, 0)), Equals, 1)
+	// a name with a legal escape is still the key as is
+	c.Assert(len(cache1.get("indices", "A%41", nil, nil, 0, 0)), Equals, 1)
+	c.Assert(cache1.partition("indices", "AA"), IsNil)
+	_, err = cache1.appendEntries("indices", "^VIX", entries[1:2], true)
+	c.Assert(err, IsNil)
+
+	cache2 := &Cache{topics: &sync.Map{}, dataDir: dataDir}
+	c.Assert(cache2.fill(), IsNil)
+	c.Assert(len(cache2.get("indices", "^VIX", nil, nil, 0, 0)), Equals, 2)
+
+	// both the legacy and the escaped directories
+	c.Assert(os.Mkdir(filepath.Join(dataDir, "indices", "^VIX"), 0755), IsNil)
+	cache3 := &Cache{topics: &sync.Map{}, dataDir: dataDir}
+	c.Assert(cache3.fill(), ErrorMatches, ".*both exist.*")
+	c.Assert(os.Remove(filepath.Join(dataDir, "indices", "^VIX")), IsNil)
+
+	// nor is a topic directory of an invalid name skipped
+	c.Assert(os.Mkdir(filepath.Join(dataDir, "bad topic"), 0755), IsNil)
+	cache4 := &Cache{topics: &sync.Map{}, dataDir: dataDir}
+	c.Assert(cache4.fill(), ErrorMatches, ".*bad topic.*")
 }
@@ -22,6 +22,12 @@ func (r *Router) Publish(topic, partition string, entries Entries) {
 	}
 }
 
+// PublishAll publishes the publications as a single message, so that they are
+// delivered together.  The message pulled is []*Publication.
+func (r *Router) PublishAll(pubs []*Publication) {
+	r.pub.In() <- pubs
+}
+
 func (r *Router) Remove(topic string) {
 	r.remove <- &Publication{
 		Topic: topic,
@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/slait/commitlog"
+	"github.com/alpacahq/slait/utils"
+)
+
+// ErrSnapshotsDisabled is returned for a snapshot when snapshot_dir is not
+// configured.
+var ErrSnapshotsDisabled = errors.New("Snapshots are disabled, set snapshot_dir to enable them")
+
+// ManifestFile is the name of the manifest file in a snapshot directory.
+const ManifestFile = "manifest.json"
+
+// Manifest describes the content of a snapshot.
+type Manifest struct {
+	CreatedAt  time.Time           `json:"created_at"`
+	Topics     []string            `json:"topics"`
+	Partitions []ManifestPartition `json:"partitions"`
+}
+
+type ManifestPartition struct {
+	Topic     string                   `json:"topic"`
+	Partition string                   `json:"partition"`
+	Files     []commitlog.SnapshotFile `json:"files"`
+}
+
+// snapshot copies the on-disk data of all the partitions to dir, which has the
+// same layout as the data directory plus the manifest file.  Each partition is
+// locked only while its position is recorded, and its segments are linked or
+// copied after that.
+func (c *Cache) snapshot(dir string) (*Manifest, error) {
+	if err := checkEmptyDir(dir); err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{CreatedAt: time.Now().UTC()}
+	var err error
+	c.topics.Range(func(key, value interface{}) bool {
+		topic := key.(string)
+		manifest.Topics = append(manifest.Topics, topic)
+		if err = os.MkdirAll(filepath.Join(dir, topic), 0755); err != nil {
+			return false
+		}
+		if err = copyMetadata(filepath.Join(c.dataDir, topic), filepath.Join(dir, topic)); err != nil {
+			return false
+		}
+		value.(*Topic).partitions.Range(func(pkey, pvalue interface{}) bool {
+			p := pvalue.(*Partition)
+			p.mu.Lock()
+			snap, e := p.clog.Snapshot(PartitionPath(dir, topic, pkey.(string)))
+			p.mu.Unlock()
+			if e == nil {
+				e = snap.Complete()
+			}
+			if e != nil {
+				err = fmt.Errorf("failed to snapshot %v/%v: %v", topic, pkey, e)
+				return false
+			}
+			manifest.Partitions = append(manifest.Partitions, ManifestPartition{
+				Topic:     topic,
+				Partition: pkey.(string),
+				Files:     snap.Files,
+			})
+			return true
+		})
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(manifest.Topics)
+	sort.Slice(manifest.Partitions, func(i, j int) bool {
+		a, b := manifest.Partitions[i], manifest.Partitions[j]
+		return a.Topic < b.Topic || (a.Topic == b.Topic && a.Partition < b.Partition)
+	})
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ManifestFile), data, 0666); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Restore copies the snapshot in snapshotDir to dataDir, which must be empty.
+// Slait should not be running on dataDir.
+func Restore(snapshotDir, dataDir string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(snapshotDir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if err := checkEmptyDir(dataDir); err != nil {
+		return nil, err
+	}
+	for _, topic := range manifest.Topics {
+		if err := ValidateTopic(topic); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+		if err := os.MkdirAll(filepath.Join(dataDir, topic), 0755); err != nil {
+			return nil, err
+		}
+		if err := copyMetadata(filepath.Join(snapshotDir, topic), filepath.Join(dataDir, topic)); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range manifest.Partitions {
+		if err := ValidateTopic(p.Topic); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+		if err := commitlog.Restore(
+			PartitionPath(snapshotDir, p.Topic, p.Partition),
+			PartitionPath(dataDir, p.Topic, p.Partition),
+			p.Files); err != nil {
+			return nil, fmt.Errorf("failed to restore %v/%v: %v", p.Topic, p.Partition, err)
+		}
+	}
+	return manifest, nil
+}
+
+// copyMetadata copies the topic metadata file from srcDir to dstDir if any.
+func copyMetadata(srcDir, dstDir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(srcDir, MetadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dstDir, MetadataFile), data, 0666)
+}
+
+func checkEmptyDir(dir string) error {
+	finfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(finfos) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+	return nil
+}
+
+// snapshotPath returns the directory of the snapshot at path, which is either
+// relative to or under the snapshot directory root.  Returns NameError if it is
+// elsewhere or in the data directory.
+func (c *Cache) snapshotPath(root, path string) (string, error) {
+	if root == "" {
+		return "", ErrSnapshotsDisabled
+	}
+	root, err := resolvePath(root)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	dir, err := resolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	if dir == root || !within(root, dir) {
+		return "", &NameError{"snapshot path", path, "not under snapshot_dir"}
+	}
+	dataDir, err := resolvePath(c.dataDir)
+	if err != nil {
+		return "", err
+	}
+	if within(dataDir, dir) {
+		return "", &NameError{"snapshot path", path, "in the data directory"}
+	}
+	return dir, nil
+}
+
+// resolvePath returns the absolute path with the symbolic links of its existing
+// part resolved.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// within returns true if path is dir or under it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Snapshot takes a consistent point-in-time snapshot of the data directory
+// while Slait is running into path, relative to or under snapshot_dir.
+func Snapshot(path string) (*Manifest, error) {
+	dir, err := masterCache.snapshotPath(utils.GlobalConfig.SnapshotDir, path)
+	if err != nil {
+		return nil, err
+	}
+	return masterCache.snapshot(dir)
+}
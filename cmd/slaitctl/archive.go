@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alpacahq/slait/cache"
+	"github.com/alpacahq/slait/commitlog"
+)
+
+const importBatchSize = 1000
+
+// archiveRecord is an entry in the NDJSON or CSV archives.  Data is the JSON
+// payload of the entry as is.
+type archiveRecord struct {
+	Topic     string          `json:"topic"`
+	Partition string          `json:"partition"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+var csvHeader = []string{"topic", "partition", "timestamp", "data"}
+
+type archiveWriter interface {
+	Write(rec *archiveRecord) error
+	Flush() error
+}
+
+type ndjsonWriter struct {
+	w *bufio.Writer
+}
+
+func (w *ndjsonWriter) Write(rec *archiveRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.w.Write(line)
+	return w.w.WriteByte('\n')
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return w.w.Flush()
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvWriter) Write(rec *archiveRecord) error {
+	return w.w.Write([]string{
+		rec.Topic,
+		rec.Partition,
+		rec.Timestamp.Format(time.RFC3339Nano),
+		string(rec.Data),
+	})
+}
+
+func (w *csvWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func newArchiveWriter(format string, out io.Writer) (archiveWriter, error) {
+	switch format {
+	case "ndjson":
+		return &ndjsonWriter{w: bufio.NewWriter(out)}, nil
+	case "csv":
+		w := csv.NewWriter(out)
+		if err := w.Write(csvHeader); err != nil {
+			return nil, err
+		}
+		return &csvWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("invalid format: %s", format)
+}
+
+// readArchive reads all the records in the archive.  The topic and partition
+// override the ones in the archive if not empty.
+func readArchive(format string, in io.Reader, topic, partition string) ([]*archiveRecord, error) {
+	records := []*archiveRecord{}
+	switch format {
+	case "ndjson":
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(nil, 64*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			rec := &archiveRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			records = append(records, rec)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case "csv":
+		reader := csv.NewReader(in)
+		reader.FieldsPerRecord = len(csvHeader)
+		rows, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, row := range rows {
+			if i == 0 && row[0] == csvHeader[0] {
+				continue
+			}
+			timestamp, err := time.Parse(time.RFC3339Nano, row[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			if !json.Valid([]byte(row[3])) {
+				return nil, fmt.Errorf("line %d: data is not valid JSON", i+1)
+			}
+			records = append(records, &archiveRecord{
+				Topic:     row[0],
+				Partition: row[1],
+				Timestamp: timestamp,
+				Data:      json.RawMessage(row[3]),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("invalid format: %s", format)
+	}
+	for i, rec := range records {
+		if topic != "" {
+			rec.Topic = topic
+		}
+		if partition != "" {
+			rec.Partition = partition
+		}
+		if rec.Topic == "" || rec.Partition == "" {
+			return nil, fmt.Errorf("record %d: topic or partition is missing", i+1)
+		}
+		if err := cache.ValidateTopic(rec.Topic); err != nil {
+			return nil, fmt.Errorf("record %d: %v", i+1, err)
+		}
+		if err := cache.ValidatePartition(rec.Partition); err != nil {
+			return nil, fmt.Errorf("record %d: %v", i+1, err)
+		}
+	}
+	return records, nil
+}
+
+func parseTimeFlag(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dataDir := dataDirFlags(fs)
+	topic := fs.String("topic", "", "topic to export (required)")
+	partition := fs.String("partition", "", "partition to export (default all the partitions)")
+	format := fs.String("format", "ndjson", "archive format, \"ndjson\" or \"csv\"")
+	fromFlag := fs.String("from", "", "export the entries at or after this RFC3339 time")
+	toFlag := fs.String("to", "", "export the entries at or before this RFC3339 time")
+	output := fs.String("o", "", "output file (default stdout)")
+	fs.Parse(args)
+
+	if *topic == "" {
+		return fmt.Errorf("-topic is required")
+	}
+	from, err := parseTimeFlag(*fromFlag)
+	if err != nil {
+		return err
+	}
+	to, err := parseTimeFlag(*toFlag)
+	if err != nil {
+		return err
+	}
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	parts, _, err := partitions(dir)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w, err := newArchiveWriter(*format, out)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, part := range parts {
+		if part[0] != *topic || (*partition != "" && part[1] != *partition) {
+			continue
+		}
+		found = true
+		if err := exportPartition(w, filepath.Join(dir, part[0], part[2]), part[0], part[1], from, to); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("no partition found for %s", *topic)
+	}
+	return w.Flush()
+}
+
+func exportPartition(w archiveWriter, path, topic, key string, from, to *time.Time) error {
+	reader, err := commitlog.NewReaderRange(path, from, to)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// the late entries may be anywhere after the range
+	reader.Lateness = -1
+	entries, err := cache.ReadEntries(reader)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := w.Write(&archiveRecord{
+			Topic:     topic,
+			Partition: key,
+			Timestamp: entry.Timestamp,
+			Data:      entry.Data,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dataDir := dataDirFlags(fs)
+	topic := fs.String("topic", "", "topic to import to (default the one in the archive)")
+	partition := fs.String("partition", "", "partition to import to (default the one in the archive)")
+	format := fs.String("format", "ndjson", "archive format, \"ndjson\" or \"csv\"")
+	input := fs.String("i", "", "input file (default stdin)")
+	fs.Parse(args)
+
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	in := os.Stdin
+	if *input != "" {
+		if in, err = os.Open(*input); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	records, err := readArchive(*format, in, *topic, *partition)
+	if err != nil {
+		return err
+	}
+
+	byPartition := map[[2]string][]*archiveRecord{}
+	keys := [][2]string{}
+	for _, rec := range records {
+		key := [2]string{rec.Topic, rec.Partition}
+		if _, ok := byPartition[key]; !ok {
+			keys = append(keys, key)
+		}
+		byPartition[key] = append(byPartition[key], rec)
+	}
+	for _, key := range keys {
+		imported, skipped, err := importPartition(dir, key[0], key[1], byPartition[key])
+		if err != nil {
+			return fmt.Errorf("%s/%s: %v", key[0], key[1], err)
+		}
+		fmt.Printf("%s/%s: %d entries imported, %d skipped\n", key[0], key[1], imported, skipped)
+	}
+	return nil
+}
+
+// legacyKeyDir returns the name of the directory in topicDir made for the key
+// before the keys were escaped on disk, or empty if there is none.  Only the
+// directories listed in topicDir are considered, so that a key such as
+// "../bars" never points outside of it.
+func legacyKeyDir(topicDir, key string) (string, error) {
+	if cache.EncodeKey(key) == key || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", nil
+	}
+	finfos, err := ioutil.ReadDir(topicDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	for _, finfo := range finfos {
+		if finfo.IsDir() && finfo.Name() == key {
+			return finfo.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// importPartition appends the records in the timestamp order.  The records
+// before the last entry of the existing partition are skipped as Slait does
+// for PUT requests.
+func importPartition(dataDir, topic, key string, records []*archiveRecord) (int, int, error) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+	// append to the partition made before the keys were escaped on disk
+	topicDir := filepath.Join(dataDir, topic)
+	if name, err := legacyKeyDir(topicDir, key); err != nil {
+		return 0, 0, err
+	} else if name != "" {
+		if _, err := cache.MigrateKeyDir(topicDir, name); err != nil {
+			return 0, 0, err
+		}
+	}
+	opts, err := cache.LogOptions(dataDir, topic, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	clog, err := commitlog.New(opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer clog.Close()
+
+	last, err := clog.LastTimestamp()
+	if err != nil {
+		return 0, 0, err
+	}
+	skipped := 0
+	batch := []*commitlog.Entry{}
+	for _, rec := range records {
+		if rec.Timestamp.Before(last) {
+			skipped++
+			continue
+		}
+		batch = append(batch, &commitlog.Entry{Timestamp: rec.Timestamp, Data: rec.Data})
+	}
+	for i := 0; i < len(batch); i += importBatchSize {
+		end := i + importBatchSize
+		if end > len(batch) {
+			end = len(batch)
+		}
+		if err := clog.AppendBatch(batch[i:end]); err != nil {
+			return i, skipped, err
+		}
+	}
+	return len(batch), skipped, clog.Sync()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alpacahq/slait/cache"
+	"github.com/alpacahq/slait/commitlog"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ArchiveTestSuite struct{}
+
+var _ = Suite(&ArchiveTestSuite{})
+
+// writePartition appends n entries a second apart from t0 to the partition.
+func writePartition(c *C, dataDir, topic, key string, t0 time.Time, n int) {
+	clog, err := commitlog.New(commitlog.Options{Path: cache.PartitionPath(dataDir, topic, key)})
+	c.Assert(err, IsNil)
+	defer clog.Close()
+	for i := 0; i < n; i++ {
+		c.Assert(clog.Append(&commitlog.Entry{
+			Timestamp: t0.Add(time.Duration(i) * time.Second),
+			Data:      []byte(`{"price":1.5}`),
+		}), IsNil)
+	}
+}
+
+func (s *ArchiveTestSuite) TestRoundTrip(c *C) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	src := c.MkDir()
+	writePartition(c, src, "bars", "AMD", t0, 3)
+	writePartition(c, src, "bars", "ES/H24", t0, 2)
+	writePartition(c, src, "quotes", "AMD", t0, 1)
+
+	for _, format := range []string{"ndjson", "csv"} {
+		archive := filepath.Join(c.MkDir(), "bars."+format)
+		c.Assert(runExport([]string{"-data_dir", src, "-topic", "bars", "-format", format, "-o", archive}), IsNil)
+		dst := c.MkDir()
+		c.Assert(runImport([]string{"-data_dir", dst, "-format", format, "-i", archive}), IsNil)
+
+		parts, strays, err := partitions(dst)
+		c.Assert(err, IsNil)
+		c.Assert(strays, HasLen, 0)
+		c.Assert(parts, DeepEquals, [][3]string{
+			{"bars", "AMD", "AMD"},
+			{"bars", "ES/H24", "ES%2FH24"},
+		})
+		reader, err := commitlog.NewReader(cache.PartitionPath(dst, "bars", "AMD"))
+		c.Assert(err, IsNil)
+		entries, err := cache.ReadEntries(reader)
+		reader.Close()
+		c.Assert(err, IsNil)
+		c.Assert(entries, HasLen, 3)
+		c.Assert(entries[2].Timestamp.Equal(t0.Add(2*time.Second)), Equals, true)
+		c.Assert(string(entries[2].Data), Equals, `{"price":1.5}`)
+
+		// the entries imported already are skipped
+		c.Assert(runImport([]string{"-data_dir", dst, "-format", format, "-i", archive}), IsNil)
+		reader, err = commitlog.NewReader(cache.PartitionPath(dst, "bars", "AMD"))
+		c.Assert(err, IsNil)
+		entries, err = cache.ReadEntries(reader)
+		reader.Close()
+		c.Assert(err, IsNil)
+		c.Assert(entries, HasLen, 4)
+	}
+}
+
+func (s *ArchiveTestSuite) TestInvalidArchive(c *C) {
+	// not an archive, e.g. a segment file
+	dataDir := c.MkDir()
+	writePartition(c, dataDir, "bars", "AMD", time.Now(), 1)
+	files, err := filepath.Glob(filepath.Join(dataDir, "bars", "AMD", "*.log"))
+	c.Assert(err, IsNil)
+	segment, err := ioutil.ReadFile(files[0])
+	c.Assert(err, IsNil)
+	_, err = readArchive("ndjson", bytes.NewReader(segment), "", "")
+	c.Assert(err, NotNil)
+	_, err = readArchive("csv", bytes.NewReader(segment), "", "")
+	c.Assert(err, NotNil)
+	_, err = readArchive("tar", strings.NewReader(""), "", "")
+	c.Assert(err, ErrorMatches, "invalid format: tar")
+
+	for _, t := range []struct {
+		format, archive, err string
+	}{
+		// truncated entries
+		{"ndjson", `{"topic":"bars","partition":"AMD","timestamp":"2018-01-01T00:00:00Z","data":{"price":1.5}}
+{"topic":"bars","partition":"AMD","timestamp":"2018-01-01T00:00:01Z","da`, "line 2: .*"},
+		{"csv", "topic,partition,timestamp,data\nbars,AMD,2018-01-01T00:00:00Z\n", ".*wrong number of fields.*"},
+		{"csv", "topic,partition,timestamp,data\nbars,AMD,2018-01-01T00:00:00Z,{\n", "line 2: data is not valid JSON"},
+		// invalid topic or key
+		{"ndjson", `{"topic":"../bars","partition":"AMD","timestamp":"2018-01-01T00:00:00Z","data":{}}`, "record 1: Invalid topic name.*"},
+		{"ndjson", `{"topic":"bars","partition":"","timestamp":"2018-01-01T00:00:00Z","data":{}}`, "record 1: topic or partition is missing"},
+		{"ndjson", `{"topic":"bars","partition":"` + strings.Repeat("/", 100) + `","timestamp":"2018-01-01T00:00:00Z","data":{}}`, "record 1: Invalid partition name.*"},
+	} {
+		_, err := readArchive(t.format, strings.NewReader(t.archive), "", "")
+		c.Assert(err, ErrorMatches, t.err)
+	}
+}
+
+func (s *ArchiveTestSuite) TestImportOutside(c *C) {
+	root := c.MkDir()
+	dataDir := filepath.Join(root, "data")
+	c.Assert(os.MkdirAll(filepath.Join(dataDir, "bars"), 0755), IsNil)
+	victim := filepath.Join(root, "victim")
+	c.Assert(os.Mkdir(victim, 0755), IsNil)
+
+	archive := filepath.Join(root, "bars.ndjson")
+	c.Assert(ioutil.WriteFile(archive, []byte(
+		`{"topic":"bars","partition":"../../victim","timestamp":"2018-01-01T00:00:00Z","data":{}}`+"\n",
+	), 0666), IsNil)
+	c.Assert(runImport([]string{"-data_dir", dataDir, "-i", archive}), IsNil)
+	// the key is escaped in the topic directory, and nothing outside is moved
+	_, err := os.Stat(victim)
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(dataDir, "bars", cache.EncodeKey("../../victim")))
+	c.Assert(err, IsNil)
+}
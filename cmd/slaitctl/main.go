@@ -0,0 +1,108 @@
+// Command slaitctl is the offline maintenance tool for the Slait data
+// directory.  Slait should not be running on the data directory while it is
+// modified by slaitctl.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/alpacahq/slait/cache"
+	"github.com/alpacahq/slait/utils"
+)
+
+type command struct {
+	run   func(args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"verify":   {runVerify, "check the segment files in the data directory"},
+	"export":   {runExport, "write the entries of a topic to an NDJSON or CSV archive"},
+	"import":   {runImport, "append the entries in an NDJSON or CSV archive to the data directory"},
+	"snapshot": {runSnapshot, "take a snapshot of the data directory of a running server"},
+	"restore":  {runRestore, "restore a snapshot to an empty data directory"},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: slaitctl <command> [options]\n\nCommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'slaitctl <command> -h' for the command options.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "slaitctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// dataDirFlags adds the flags to locate the data directory, either directly or
+// from the Slait configuration file.  The configuration file is also loaded for
+// the per-topic settings if it exists.
+func dataDirFlags(fs *flag.FlagSet) func() (string, error) {
+	configFlag := fs.String("config", "slait.yaml", "Slait YAML configuration file to read data_dir from")
+	dataDirFlag := fs.String("data_dir", "", "data directory, overrides the configuration file")
+	return func() (string, error) {
+		data, err := ioutil.ReadFile(*configFlag)
+		if err == nil {
+			err = utils.ParseConfig(data)
+		}
+		if *dataDirFlag != "" {
+			return *dataDirFlag, nil
+		} else if err != nil {
+			return "", err
+		}
+		return utils.GlobalConfig.DataDir, nil
+	}
+}
+
+// partitions lists the topics, partition keys and partition directory names in
+// the data directory.  The other files are returned as strays.
+func partitions(dataDir string) (parts [][3]string, strays []string, err error) {
+	topics, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, topic := range topics {
+		if !topic.IsDir() {
+			strays = append(strays, topic.Name())
+			continue
+		}
+		keys, err := ioutil.ReadDir(filepath.Join(dataDir, topic.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range keys {
+			if key.Name() == cache.MetadataFile {
+				continue
+			}
+			if !key.IsDir() {
+				strays = append(strays, filepath.Join(topic.Name(), key.Name()))
+				continue
+			}
+			parts = append(parts, [3]string{topic.Name(), cache.KeyOfDir(key.Name()), key.Name()})
+		}
+	}
+	return parts, strays, nil
+}
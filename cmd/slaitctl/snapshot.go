@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/alpacahq/slait/cache"
+	"github.com/alpacahq/slait/rest/client"
+)
+
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "http://localhost:5994", "Slait server URL")
+	path := fs.String("path", "", "directory to write the snapshot to, relative to or under snapshot_dir of the server (required, must be empty)")
+	fs.Parse(args)
+
+	if *path == "" {
+		return fmt.Errorf("-path is required")
+	}
+	sc := client.SlaitClient{Endpoint: *endpoint}
+	manifest, err := sc.Snapshot(*path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot of %d topics and %d partitions written to %s\n",
+		len(manifest.Topics), len(manifest.Partitions), *path)
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dataDir := dataDirFlags(fs)
+	snapshot := fs.String("snapshot", "", "snapshot directory to restore from (required)")
+	fs.Parse(args)
+
+	if *snapshot == "" {
+		return fmt.Errorf("-snapshot is required")
+	}
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	manifest, err := cache.Restore(*snapshot, dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot taken at %v restored to %s (%d topics, %d partitions)\n",
+		manifest.CreatedAt, dir, len(manifest.Topics), len(manifest.Partitions))
+	return nil
+}
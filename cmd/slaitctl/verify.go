@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/alpacahq/slait/cache"
+	"github.com/alpacahq/slait/commitlog"
+)
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dataDir := dataDirFlags(fs)
+	repair := fs.String("repair", "", "repair mode: \"truncate\" truncates corrupt segments at the first bad record "+
+		"and deletes unreadable and stray files, \"quarantine\" moves them to -quarantine_dir")
+	quarantineDir := fs.String("quarantine_dir", "", "directory to move the bad files to (default <data_dir>.quarantine)")
+	fs.Parse(args)
+
+	mode := commitlog.RepairMode(*repair)
+	switch mode {
+	case commitlog.RepairNone, commitlog.RepairTruncate, commitlog.RepairQuarantine:
+	default:
+		return fmt.Errorf("invalid repair mode: %s", *repair)
+	}
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	if *quarantineDir == "" {
+		*quarantineDir = filepath.Clean(dir) + ".quarantine"
+	}
+
+	parts, strays, err := partitions(dir)
+	if err != nil {
+		return err
+	}
+	unrepaired := 0
+	for _, stray := range strays {
+		problem, err := commitlog.RepairStray(
+			filepath.Join(dir, stray), mode,
+			filepath.Join(*quarantineDir, filepath.Dir(stray)))
+		if err != nil {
+			return err
+		}
+		fmt.Println(problem)
+		if !problem.Repaired {
+			unrepaired++
+		}
+	}
+	for _, part := range parts {
+		result, err := commitlog.Verify(
+			filepath.Join(dir, part[0], part[2]), mode,
+			cache.PartitionPath(*quarantineDir, part[0], part[1]))
+		if err != nil {
+			return err
+		}
+		for _, problem := range result.Problems {
+			fmt.Println(problem)
+			if !problem.Repaired {
+				unrepaired++
+			}
+		}
+		fmt.Printf("%s/%s: %d segments, %d entries, %d problems\n",
+			part[0], part[1], result.Segments, result.Entries, len(result.Problems))
+	}
+	if unrepaired > 0 {
+		return fmt.Errorf("%d problems found", unrepaired)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type VerifyTestSuite struct{}
+
+var _ = Suite(&VerifyTestSuite{})
+
+func (s *VerifyTestSuite) TestStrays(c *C) {
+	for _, mode := range []string{"truncate", "quarantine"} {
+		dataDir := filepath.Join(c.MkDir(), "data")
+		writePartition(c, dataDir, "bars", "AMD", time.Now(), 2)
+		strays := []string{"notes.txt", filepath.Join("bars", "notes.txt")}
+		for _, stray := range strays {
+			c.Assert(ioutil.WriteFile(filepath.Join(dataDir, stray), []byte("x"), 0666), IsNil)
+		}
+
+		c.Assert(runVerify([]string{"-data_dir", dataDir}), ErrorMatches, "2 problems found")
+		c.Assert(runVerify([]string{"-data_dir", dataDir, "-repair", mode}), IsNil)
+		c.Assert(runVerify([]string{"-data_dir", dataDir}), IsNil)
+		for _, stray := range strays {
+			_, err := os.Stat(filepath.Join(dataDir, stray))
+			c.Assert(os.IsNotExist(err), Equals, true)
+			_, err = os.Stat(filepath.Join(dataDir+".quarantine", stray))
+			c.Assert(err == nil, Equals, mode == "quarantine")
+		}
+	}
+}
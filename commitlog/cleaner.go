@@ -11,45 +11,86 @@ type Cleaner interface {
 	Clean([]*Segment) ([]*Segment, error)
 }
 
+// CleanerOptions configures the cleaner.  Options["Name"] is one of "Duration",
+// "ByteSize", "EntryCount" or "Composite".  The composite cleaner applies all
+// the policies configured by "Duration", "MaxLogBytes" and "MaxEntries".
 type CleanerOptions map[string]string
 
 func NewCleaner(options CleanerOptions) Cleaner {
 	name, _ := options["Name"]
 	switch name {
 	case "Duration":
-		durationStr, ok := options["Duration"]
-		duration := time.Duration(5 * 24 * time.Hour)
-		if ok {
-			temp, err := time.ParseDuration(durationStr)
-			if err != nil {
-				log.Warning("Parsing Duration failed: %s, %v", durationStr, err)
-			} else {
-				duration = temp
-			}
+		return newDurationCleaner(options)
+	case "EntryCount":
+		return newEntryCountCleaner(options)
+	case "Composite":
+		cleaner := &CompositeCleaner{Options: options}
+		if _, ok := options["Duration"]; ok {
+			cleaner.Cleaners = append(cleaner.Cleaners, newDurationCleaner(options))
 		}
-		return &DurationCleaner{
-			Options:  options,
-			Duration: duration,
+		if _, ok := options["MaxLogBytes"]; ok {
+			cleaner.Cleaners = append(cleaner.Cleaners, newByteSizeCleaner(options))
 		}
-
+		if _, ok := options["MaxEntries"]; ok {
+			cleaner.Cleaners = append(cleaner.Cleaners, newEntryCountCleaner(options))
+		}
+		return cleaner
 	case "ByteSize":
 		fallthrough
 	default:
-		maxLogBytesStr, ok := options["MaxLogBytes"]
-		maxLogBytes := int64(10 * 32 * 1024 * 1024)
-		if ok {
-			temp, err := strconv.Atoi(maxLogBytesStr)
-			if err != nil {
-				log.Warning("Parsing MaxLogBytes failed: %s", maxLogBytesStr)
-			} else {
-				maxLogBytes = int64(temp)
-			}
+		return newByteSizeCleaner(options)
+	}
+}
+
+func newDurationCleaner(options CleanerOptions) *DurationCleaner {
+	durationStr, ok := options["Duration"]
+	duration := time.Duration(5 * 24 * time.Hour)
+	if ok {
+		temp, err := time.ParseDuration(durationStr)
+		if err != nil {
+			log.Warning("Parsing Duration failed: %s, %v", durationStr, err)
+		} else {
+			duration = temp
+		}
+	}
+	return &DurationCleaner{
+		Options:  options,
+		Duration: duration,
+	}
+}
+
+func newByteSizeCleaner(options CleanerOptions) *ByteSizeCleaner {
+	maxLogBytesStr, ok := options["MaxLogBytes"]
+	maxLogBytes := int64(10 * 32 * 1024 * 1024)
+	if ok {
+		temp, err := strconv.ParseInt(maxLogBytesStr, 10, 64)
+		if err != nil {
+			log.Warning("Parsing MaxLogBytes failed: %s", maxLogBytesStr)
+		} else {
+			maxLogBytes = temp
 		}
-		return &ByteSizeCleaner{
-			Options:     options,
-			MaxLogBytes: maxLogBytes,
+	}
+	return &ByteSizeCleaner{
+		Options:     options,
+		MaxLogBytes: maxLogBytes,
+	}
+}
+
+func newEntryCountCleaner(options CleanerOptions) *EntryCountCleaner {
+	maxEntriesStr, ok := options["MaxEntries"]
+	maxEntries := int64(-1)
+	if ok {
+		temp, err := strconv.ParseInt(maxEntriesStr, 10, 64)
+		if err != nil {
+			log.Warning("Parsing MaxEntries failed: %s", maxEntriesStr)
+		} else {
+			maxEntries = temp
 		}
 	}
+	return &EntryCountCleaner{
+		Options:    options,
+		MaxEntries: maxEntries,
+	}
 }
 
 // ByteSizeCleaner deletes leading segment files based on the total byte size of segments
@@ -63,33 +104,79 @@ type ByteSizeCleaner struct {
 // Clean deletes segment files so that the sum of the segment files in bytes are
 // less than maxLogBytes.  It keeps at least one segment file if there are any.
 func (cleaner *ByteSizeCleaner) Clean(segments []*Segment) ([]*Segment, error) {
-	if len(segments) == 0 || cleaner.MaxLogBytes == -1 {
+	if cleaner.MaxLogBytes == -1 {
+		return segments, nil
+	}
+	return cleanByTotal(segments, cleaner.MaxLogBytes, func(s *Segment) (int64, error) {
+		return s.Size, nil
+	})
+}
+
+// EntryCountCleaner deletes leading segment files based on the total number of
+// entries in the segments
+type EntryCountCleaner struct {
+	// Options["MaxEntries"] should be number string accepted by strconv.ParseInt()
+	Options CleanerOptions
+	// -1 to avoid any deletes
+	MaxEntries int64
+}
+
+// Clean deletes segment files so that the total number of the entries in the
+// segment files are less than MaxEntries.  It keeps at least one segment file
+// if there are any.
+func (cleaner *EntryCountCleaner) Clean(segments []*Segment) ([]*Segment, error) {
+	if cleaner.MaxEntries == -1 {
+		return segments, nil
+	}
+	return cleanByTotal(segments, cleaner.MaxEntries, func(s *Segment) (int64, error) {
+		return s.EntryCount()
+	})
+}
+
+// cleanByTotal deletes the leading segments so that the total of the
+// measure of the rest is less than max, keeping at least the last segment.
+func cleanByTotal(segments []*Segment, max int64, measure func(*Segment) (int64, error)) ([]*Segment, error) {
+	if len(segments) == 0 {
 		return segments, nil
 	}
-	cleanedSegments := []*Segment{segments[len(segments)-1]}
-	totalBytes := cleanedSegments[0].Size
-	if len(segments) > 1 {
-		var i int
-		for i = len(segments) - 2; i > -1; i-- {
-			s := segments[i]
-			totalBytes += s.Size
-			if totalBytes > cleaner.MaxLogBytes {
-				break
-			}
-			// cleanedSegments = append([]*Segment{s}, cleanedSegments...)
+	total := int64(0)
+	var i int
+	for i = len(segments) - 1; i > -1; i-- {
+		m, err := measure(segments[i])
+		if err != nil {
+			log.Error("Failed to measure %v: %v", segments[i], err)
+			return segments, err
+		}
+		total += m
+		if total > max && i < len(segments)-1 {
+			break
+		}
+	}
+	for j := 0; j <= i; j++ {
+		s := segments[j]
+		if err := s.Delete(); err != nil {
+			log.Error("Failed to delete %v: %v", s, err)
+			return segments[j:], err
 		}
-		if i > -1 {
-			for j := 0; j <= i; j++ {
-				s := segments[j]
-				if err := s.Delete(); err != nil {
-					log.Error("Failed to delete %v: %v", s, err)
-					return segments[j:], err
-				}
-			}
-			cleanedSegments = segments[i+1:]
+	}
+	return segments[i+1:], nil
+}
+
+// CompositeCleaner applies all of the cleaners, so the segments are deleted if
+// any of the cleaners decides to.
+type CompositeCleaner struct {
+	Options  CleanerOptions
+	Cleaners []Cleaner
+}
+
+func (cleaner *CompositeCleaner) Clean(segments []*Segment) ([]*Segment, error) {
+	var err error
+	for _, c := range cleaner.Cleaners {
+		if segments, err = c.Clean(segments); err != nil {
+			return segments, err
 		}
 	}
-	return cleanedSegments, nil
+	return segments, nil
 }
 
 // DurationCleaner deletes leading segments based on -1 * duration from time.Now()
@@ -100,8 +187,6 @@ type DurationCleaner struct {
 }
 
 func (cleaner *DurationCleaner) Clean(segments []*Segment) ([]*Segment, error) {
-	// XXX Since there is no way to know the last timestamp without reading the
-	// whole file, it may be better to implement this differently.
 	if len(segments) == 0 {
 		return segments, nil
 	}
@@ -109,12 +194,12 @@ func (cleaner *DurationCleaner) Clean(segments []*Segment) ([]*Segment, error) {
 	cutoffIdx := len(segments) - 1
 	// Always leave last segment
 	for i, segment := range segments[:len(segments)-1] {
-		lastEntry, err := readLastEntry(segment)
+		lastTime, err := segment.LastTimestamp()
 		if err != nil {
 			log.Error("Failed to read entry from %v: %v", segment, err)
 			return segments[i:], err
 		}
-		if lastEntry.Timestamp.After(cutoff) || lastEntry.Timestamp.Equal(cutoff) {
+		if lastTime.After(cutoff) || lastTime.Equal(cutoff) {
 			cutoffIdx = i
 			break
 		}
@@ -125,21 +210,3 @@ func (cleaner *DurationCleaner) Clean(segments []*Segment) ([]*Segment, error) {
 	}
 	return segments[cutoffIdx:], nil
 }
-
-func readLastEntry(segment *Segment) (*Entry, error) {
-	// close to make sure read it from the beginning
-	segment.Close()
-	// and close it again on return
-	defer segment.Close()
-
-	var lastEntry *Entry
-	for {
-		entry, err := segment.ReadEntry()
-		if err != nil {
-			return nil, err
-		} else if entry == nil {
-			return lastEntry, nil
-		}
-		lastEntry = entry
-	}
-}
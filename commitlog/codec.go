@@ -0,0 +1,97 @@
+package commitlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/pkg/errors"
+)
+
+// Codec is the compression codec of the record payloads.
+type Codec string
+
+const (
+	CodecNone   Codec = "none"
+	CodecGzip   Codec = "gzip"
+	CodecSnappy Codec = "snappy"
+	// codecZstd is not supported yet.  The pure Go zstd in klauspost/compress
+	// needs a newer Go than Slait builds with, so it is deferred until then.
+	codecZstd Codec = "zstd"
+)
+
+// The lowest 3 bits of the record attributes tell the codec of the payload.
+const (
+	attrCodecMask   byte = 0x07
+	attrCodecNone   byte = 0
+	attrCodecGzip   byte = 1
+	attrCodecSnappy byte = 2
+	// attrCodecZstd is reserved for codecZstd
+	attrCodecZstd byte = 3
+)
+
+func (c Codec) valid() bool {
+	switch c {
+	case CodecNone, CodecGzip, CodecSnappy:
+		return true
+	}
+	return false
+}
+
+// compress returns the compressed payload with the attributes for the codec.
+// The payload is returned as is if the compression does not make it smaller,
+// so that the small records do not pay the overhead.
+func compress(codec Codec, payload []byte) ([]byte, byte) {
+	var (
+		data []byte
+		attr byte
+	)
+	switch codec {
+	case CodecGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(payload); err != nil {
+			return payload, attrCodecNone
+		}
+		if err := w.Close(); err != nil {
+			return payload, attrCodecNone
+		}
+		data, attr = buf.Bytes(), attrCodecGzip
+	case CodecSnappy:
+		data, attr = snappy.Encode(nil, payload), attrCodecSnappy
+	default:
+		return payload, attrCodecNone
+	}
+	if len(data) >= len(payload) {
+		return payload, attrCodecNone
+	}
+	return data, attr
+}
+
+// decompress restores the payload according to the record attributes.
+func decompress(attr byte, data []byte) ([]byte, error) {
+	switch attr & attrCodecMask {
+	case attrCodecNone:
+		return data, nil
+	case attrCodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip decompression failed")
+		}
+		defer r.Close()
+		payload, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip decompression failed")
+		}
+		return payload, nil
+	case attrCodecSnappy:
+		payload, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, errors.Wrap(err, "snappy decompression failed")
+		}
+		return payload, nil
+	default:
+		return nil, errors.Errorf("unknown compression codec %d", attr&attrCodecMask)
+	}
+}
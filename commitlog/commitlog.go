@@ -10,6 +10,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/alpacahq/slait/utils/log"
 	"github.com/pkg/errors"
 )
 
@@ -20,6 +21,8 @@ var (
 
 const (
 	LogFileSuffix = ".log"
+
+	defaultMaxSegmentBytes = 32 * 1024
 )
 
 type CommitLog struct {
@@ -28,17 +31,92 @@ type CommitLog struct {
 	name           string
 	segments       []*Segment
 	vActiveSegment atomic.Value
+	// dirty is true if there are appended entries not synced yet
+	dirty        bool
+	segmentAdded bool
+	lastSync     time.Time
+	// nextOffset is the offset of the next appended entry
+	nextOffset int64
+	// lastNano is the latest timestamp of the entries
+	lastNano int64
 }
 
+// SyncPolicy defines when the appended entries are synced to the disk.
+type SyncPolicy string
+
+const (
+	// SyncNone leaves it to the OS when to write the data back to the disk.
+	SyncNone SyncPolicy = "none"
+	// SyncAlways syncs on every Append and AppendBatch.
+	SyncAlways SyncPolicy = "always"
+	// SyncBatch syncs on every Commit, which the caller calls after a batch of Appends.
+	SyncBatch SyncPolicy = "batch"
+	// SyncInterval syncs on Commit if SyncInterval has passed since the last sync.
+	SyncInterval SyncPolicy = "interval"
+)
+
 type Options struct {
 	Path            string
 	MaxSegmentBytes int64
-	CleanerOptions  CleanerOptions
+	// MaxSegmentSpan rolls a new segment for the entry whose timestamp is
+	// MaxSegmentSpan or more after the first one in the active segment.
+	MaxSegmentSpan time.Duration
+	// MaxSegmentAge rolls a new segment when the active segment has been
+	// appended to for MaxSegmentAge of wall-clock time since it was created.
+	// The age of a segment loaded from disk is from the earlier of its first
+	// record and its modification time.
+	MaxSegmentAge  time.Duration
+	CleanerOptions CleanerOptions
+	// IndexIntervalBytes is the minimum number of bytes between the entries of
+	// the segment index files.  The index files are not maintained if it is 0.
+	IndexIntervalBytes int64
+	// SyncPolicy is SyncNone if empty
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+	// Codec compresses the payload of the new records.  CodecNone if empty.
+	Codec Codec
+	// ReadOnly skips the recovery of the torn records on open, so that
+	// readers never modify the files.
+	ReadOnly bool
 }
 
 type Entry struct {
 	Timestamp time.Time
 	Data      []byte
+	// Offset is the sequence number of the entry in the log, assigned on
+	// append.  It is 0 for the entries written in the older formats.
+	Offset int64
+	// Replace tells the readers to replace the entries before it of the same
+	// timestamp with it.
+	Replace bool
+	// ID is the optional identifier of the entry given by the producer.
+	ID string
+	// late is true if the entry is older than an entry before it in the log
+	late bool
+}
+
+func (e *Entry) flags() byte {
+	var flags byte
+	if e.late {
+		flags |= attrLate
+	}
+	if e.Replace {
+		flags |= attrReplace
+	}
+	if e.ID != "" {
+		flags |= attrID
+	}
+	return flags
+}
+
+// payload returns the data of the entry prefixed with the ID if any.
+func (e *Entry) payload() []byte {
+	if e.ID == "" {
+		return e.Data
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(e.ID)+len(e.Data))
+	n := binary.PutUvarint(buf, uint64(len(e.ID)))
+	return append(append(buf[:n], e.ID...), e.Data...)
 }
 
 // position is a file position pointer.  We keep it private for now
@@ -46,6 +124,9 @@ type Entry struct {
 type position struct {
 	segment *Segment
 	offset  int64
+	// nextOffset and lastNano are the state of the log to resume from
+	nextOffset int64
+	lastNano   int64
 }
 
 func New(opts Options) (*CommitLog, error) {
@@ -54,7 +135,27 @@ func New(opts Options) (*CommitLog, error) {
 	}
 
 	if opts.MaxSegmentBytes == 0 {
-		opts.MaxSegmentBytes = 32 * 1024
+		opts.MaxSegmentBytes = defaultMaxSegmentBytes
+	}
+
+	if opts.Codec == "" {
+		opts.Codec = CodecNone
+	} else if opts.Codec == codecZstd {
+		return nil, errors.Errorf("codec %s is not supported yet, use gzip or snappy", opts.Codec)
+	} else if !opts.Codec.valid() {
+		return nil, errors.Errorf("invalid codec: %s", opts.Codec)
+	}
+
+	switch opts.SyncPolicy {
+	case "":
+		opts.SyncPolicy = SyncNone
+	case SyncNone, SyncAlways, SyncBatch:
+	case SyncInterval:
+		if opts.SyncInterval <= 0 {
+			return nil, errors.New("sync interval must be positive")
+		}
+	default:
+		return nil, errors.Errorf("invalid sync policy: %s", opts.SyncPolicy)
 	}
 
 	path, _ := filepath.Abs(opts.Path)
@@ -88,39 +189,219 @@ func (l *CommitLog) init() error {
 }
 
 func (l *CommitLog) open() error {
+	if _, err := l.loadSegments(); err != nil {
+		return err
+	}
+	if l.ReadOnly {
+		return nil
+	}
+	// the process may have died in the middle of an append
+	if segment := l.activeSegment(); segment != nil {
+		dropped, err := segment.recoverTail()
+		if err != nil {
+			return err
+		}
+		if dropped > 0 {
+			log.Warning("Dropped %d bytes of torn records at the tail of %s", dropped, segment.filePath)
+		}
+	}
+	nextOffset, err := l.loadNextOffset()
+	if err != nil {
+		return err
+	}
+	l.nextOffset = nextOffset
+	last, err := l.LastTimestamp()
+	if err != nil {
+		return err
+	}
+	if !last.IsZero() {
+		l.lastNano = last.UnixNano()
+	}
+	return nil
+}
+
+// loadNextOffset returns the offset following the last entry.  If the log
+// only has the entries of the older formats without offsets, the offsets start
+// from the number of the existing entries.
+func (l *CommitLog) loadNextOffset() (int64, error) {
+	for i := len(l.segments) - 1; i >= 0 && l.segments[i].version >= formatV2; i-- {
+		last, err := l.segments[i].lastEntry()
+		if err != nil {
+			return 0, err
+		} else if last != nil {
+			return last.Offset + 1, nil
+		}
+	}
+	count := int64(0)
+	for _, segment := range l.segments {
+		n, err := segment.EntryCount()
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// loadSegments adds the segment files newer than the active segment in the
+// directory.  Returns the number of segments added.
+func (l *CommitLog) loadSegments() (int, error) {
 	files, err := ioutil.ReadDir(l.Path)
 	if err != nil {
-		return errors.Wrap(err, "read dir failed")
+		return 0, errors.Wrap(err, "read dir failed")
 	}
+	added := 0
 	for _, file := range files {
 		if strings.HasSuffix(file.Name(), LogFileSuffix) {
 			stem := strings.TrimSuffix(file.Name(), LogFileSuffix)
-			baseNano, err := strconv.Atoi(stem)
-			segment, err := NewSegment(l.Path, int64(baseNano), l.MaxSegmentBytes)
+			baseNano, err := strconv.ParseInt(stem, 10, 64)
 			if err != nil {
-				return err
+				continue
+			}
+			if active := l.activeSegment(); active != nil && baseNano <= active.BaseNano {
+				continue
+			}
+			segment, err := l.newSegment(baseNano)
+			if err != nil {
+				return added, err
 			}
 			l.segments = append(l.segments, segment)
+			added++
 		}
 	}
-	return nil
+	return added, nil
 }
 
+// Append appends the entry with the next offset, which is set to entry.Offset.
+// The entry may be older than the ones before it, in which case it is marked
+// as late so that the readers can find it.
 func (l *CommitLog) Append(entry *Entry) error {
-	if l.checkSplit() {
-		if err := l.split(entry.Timestamp.UnixNano()); err != nil {
+	return l.AppendBatch([]*Entry{entry})
+}
+
+// AppendBatch appends the entries with as few writes as possible.  The entries
+// are written to the active segment in a single write until it gets full, and
+// then to a new segment as Append does.  If any of the writes fails, the log is
+// truncated back to the position before the batch.  The offsets are assigned
+// to the entries in order.
+func (l *CommitLog) AppendBatch(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	start := l.Tell()
+	lastNano := l.lastNano
+	for i, entry := range entries {
+		entry.Offset = l.nextOffset + int64(i)
+		nanosec := entry.Timestamp.UnixNano()
+		entry.late = nanosec < lastNano
+		if nanosec > lastNano {
+			lastNano = nanosec
+		}
+	}
+	l.nextOffset += int64(len(entries))
+	for len(entries) > 0 {
+		nanosec := entries[0].Timestamp.UnixNano()
+		if l.checkSplit(nanosec) {
+			// a segment starting with a late entry is named after the latest
+			// timestamp so far, so that the segments stay in the time order,
+			// and always after the active one not to share its file
+			if nanosec < l.lastNano {
+				nanosec = l.lastNano
+			}
+			if active := l.activeSegment(); active != nil && nanosec <= active.BaseNano {
+				nanosec = active.BaseNano + 1
+			}
+			if err := l.split(nanosec); err != nil {
+				l.rollback(start)
+				return err
+			}
+		}
+		n, err := l.activeSegment().AppendEntries(entries)
+		if err != nil {
+			l.rollback(start)
 			return err
 		}
+		for _, entry := range entries[:n] {
+			if nanosec := entry.Timestamp.UnixNano(); nanosec > l.lastNano {
+				l.lastNano = nanosec
+			}
+		}
+		l.dirty = true
+		entries = entries[n:]
 	}
-	if err := l.activeSegment().AppendEntry(entry); err != nil {
-		return err
+	if l.SyncPolicy == SyncAlways {
+		if err := l.Sync(); err != nil {
+			// the entries may not survive a power loss, so none is appended
+			l.rollback(start)
+			return err
+		}
 	}
 	return nil
 }
 
+func (l *CommitLog) rollback(backTo *position) {
+	if err := l.Truncate(backTo); err != nil {
+		log.Error("Failed to roll back %s: %v", l.Path, err)
+	}
+}
+
+// Commit makes the appended entries durable according to the sync policy.
+// The caller is supposed to call this after a batch of Appends.
+func (l *CommitLog) Commit() error {
+	switch l.SyncPolicy {
+	case SyncBatch:
+		return l.Sync()
+	case SyncInterval:
+		if time.Since(l.lastSync) >= l.SyncInterval {
+			return l.Sync()
+		}
+	}
+	return nil
+}
+
+// Sync flushes the appended entries to the disk.
+func (l *CommitLog) Sync() error {
+	if !l.dirty {
+		return nil
+	}
+	if segment := l.activeSegment(); segment != nil {
+		if err := segment.Sync(); err != nil {
+			return errors.Wrap(err, "sync failed")
+		}
+	}
+	if l.segmentAdded {
+		// make sure the new segment files are found after a power loss
+		if err := syncDir(l.Path); err != nil {
+			return errors.Wrap(err, "sync failed")
+		}
+		l.segmentAdded = false
+	}
+	l.dirty = false
+	l.lastSync = time.Now()
+	return nil
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return syncFile(dir)
+}
+
 func (l *CommitLog) Truncate(backTo *position) error {
+	l.nextOffset = backTo.nextOffset
+	l.lastNano = backTo.lastNano
 	if backTo.segment == nil {
-		return l.DeleteAll()
+		// truncate back to no content
+		for _, segment := range l.segments {
+			if err := segment.Delete(); err != nil {
+				return err
+			}
+		}
+		l.segments = nil
+		return nil
 	}
 
 	lastSegmentIdx := -1
@@ -147,14 +428,18 @@ func (l *CommitLog) Truncate(backTo *position) error {
 func (l *CommitLog) Tell() *position {
 	if len(l.segments) == 0 {
 		return &position{
-			segment: nil, // nil indicates there is no content
-			offset:  0,
+			segment:    nil, // nil indicates there is no content
+			offset:     0,
+			nextOffset: l.nextOffset,
+			lastNano:   l.lastNano,
 		}
 	}
 	segment := l.activeSegment()
 	return &position{
-		segment: segment,
-		offset:  segment.Size,
+		segment:    segment,
+		offset:     segment.Size,
+		nextOffset: l.nextOffset,
+		lastNano:   l.lastNano,
 	}
 }
 
@@ -178,6 +463,71 @@ func (l *CommitLog) Trim() (time.Time, error) {
 	return upto, err
 }
 
+// SetCleanerOptions replaces the retention policy of the log.  It takes
+// effect on the next Trim.
+func (l *CommitLog) SetCleanerOptions(opts CleanerOptions) {
+	l.CleanerOptions = opts
+	l.cleaner = NewCleaner(opts)
+}
+
+// SetMaxSegmentBytes changes the maximum segment size, including the one of
+// the active segment.  0 restores the default.
+func (l *CommitLog) SetMaxSegmentBytes(maxBytes int64) {
+	if maxBytes == 0 {
+		maxBytes = defaultMaxSegmentBytes
+	}
+	l.MaxSegmentBytes = maxBytes
+	if segment := l.activeSegment(); segment != nil {
+		segment.maxBytes = maxBytes
+	}
+}
+
+// NextOffset returns the offset to be assigned to the next appended entry.
+func (l *CommitLog) NextOffset() int64 {
+	return l.nextOffset
+}
+
+// LastIDs returns the IDs of the last n entries, in the log order.  The entries
+// without one are skipped.  The segments are read backwards only until the
+// last n entries are read.
+func (l *CommitLog) LastIDs(n int) ([]string, error) {
+	ids := []string{}
+	if n <= 0 {
+		return ids, nil
+	}
+	from := l.nextOffset - int64(n)
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		segmentIDs, before, err := l.segments[i].ids(from)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(segmentIDs, ids...)
+		if before {
+			break
+		}
+	}
+	return ids, nil
+}
+
+// LastTimestamp returns the latest timestamp of the entries in the log.  A
+// zero time is returned if the log is empty.
+func (l *CommitLog) LastTimestamp() (time.Time, error) {
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		last, err := l.segments[i].LastTimestamp()
+		if err != nil {
+			return last, err
+		} else if last.IsZero() {
+			continue
+		}
+		// the segment may have only late entries, older than its base
+		if base := time.Unix(0, l.segments[i].BaseNano).UTC(); base.After(last) {
+			last = base
+		}
+		return last, nil
+	}
+	return time.Time{}, nil
+}
+
 func (l *CommitLog) activeSegment() *Segment {
 	if len(l.segments) > 0 {
 		return l.segments[len(l.segments)-1]
@@ -205,23 +555,45 @@ func (l *CommitLog) Segments() []*Segment {
 	return l.segments
 }
 
-func (l *CommitLog) checkSplit() bool {
+func (l *CommitLog) newSegment(baseNano int64) (*Segment, error) {
+	segment, err := NewSegment(l.Path, baseNano, l.MaxSegmentBytes)
+	if err != nil {
+		return nil, err
+	}
+	segment.maxSpan = int64(l.MaxSegmentSpan)
+	segment.maxAge = l.MaxSegmentAge
+	if !l.ReadOnly {
+		segment.indexInterval = l.IndexIntervalBytes
+		segment.codec = l.Codec
+	}
+	return segment, nil
+}
+
+// checkSplit returns true if the entry at nanosec should go to a new segment.
+func (l *CommitLog) checkSplit(nanosec int64) bool {
 	if len(l.segments) == 0 {
 		return true
 	}
-	return l.activeSegment().IsFull()
+	segment := l.activeSegment()
+	return segment.IsFull() || !segment.accepts(nanosec)
 }
 
 func (l *CommitLog) split(baseNanosec int64) error {
 	lastActive := l.activeSegment()
-	segment, err := NewSegment(l.Path, baseNanosec, l.MaxSegmentBytes)
+	segment, err := l.newSegment(baseNanosec)
 	if err != nil {
 		return err
 	}
 	segments := append(l.segments, segment)
 	if lastActive != nil {
+		if l.dirty && l.SyncPolicy != SyncNone {
+			if err := lastActive.Sync(); err != nil {
+				return errors.Wrap(err, "sync failed")
+			}
+		}
 		lastActive.Close()
 	}
+	l.segmentAdded = true
 	// segments, err = l.cleaner.Clean(segments)
 	// if err != nil {
 	// 	return err
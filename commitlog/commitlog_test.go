@@ -2,6 +2,9 @@ package commitlog
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -52,8 +55,8 @@ func (s *CommitLogTestSuite) TestAppend(c *C) {
 
 	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
 	entry1 := &Entry{
-		t1,
-		[]byte(strings.Repeat("foobar", 10)),
+		Timestamp: t1,
+		Data:      []byte(strings.Repeat("foobar", 10)),
 	}
 	if err := clog.Append(entry1); err != nil {
 		c.Fatal(err)
@@ -63,8 +66,8 @@ func (s *CommitLogTestSuite) TestAppend(c *C) {
 
 	t2 := time.Date(2017, 8, 21, 16, 45, 13, 95638, time.UTC)
 	entry2 := &Entry{
-		t2,
-		[]byte(strings.Repeat("take2", 10)),
+		Timestamp: t2,
+		Data:      []byte(strings.Repeat("take2", 10)),
 	}
 	if err := clog.Append(entry2); err != nil {
 		c.Fatal(err)
@@ -99,7 +102,7 @@ func (s *CommitLogTestSuite) TestTrim(c *C) {
 
 	clog, err := New(Options{
 		Path:            path,
-		MaxSegmentBytes: 50,
+		MaxSegmentBytes: 80,
 		CleanerOptions: CleanerOptions{
 			"Name":     "Duration",
 			"Duration": "1h",
@@ -142,6 +145,36 @@ func (s *CommitLogTestSuite) TestTrim(c *C) {
 	c.Assert(upto, Equals, t2)
 }
 
+func (s *CommitLogTestSuite) TestSnapshot(c *C) {
+	clog, err := New(Options{
+		Path:            c.MkDir(),
+		MaxSegmentBytes: 80,
+		CleanerOptions: CleanerOptions{
+			"Name":     "Duration",
+			"Duration": "1h",
+		},
+	})
+	c.Assert(err, IsNil)
+	t1 := time.Now().Add(-5 * time.Hour).UTC()
+	for i := 0; i < 4; i++ {
+		c.Assert(clog.Append(&Entry{Timestamp: t1.Add(time.Duration(i) * time.Second), Data: []byte("xxxxxxxxxx")}), IsNil)
+	}
+	c.Assert(len(clog.segments), Equals, 2)
+	snap, err := clog.Snapshot(filepath.Join(c.MkDir(), "snap"))
+	c.Assert(err, IsNil)
+
+	// the log is modified before the snapshot is completed
+	t2 := time.Now().UTC()
+	c.Assert(clog.Append(&Entry{Timestamp: t2, Data: []byte("zzzzzzzzzz")}), IsNil)
+	_, err = clog.Trim()
+	c.Assert(err, IsNil)
+	c.Assert(len(clog.segments), Equals, 1)
+	c.Assert(snap.Complete(), IsNil)
+	entries := readEntries(snap.Dir, c)
+	c.Assert(len(entries), Equals, 4)
+	c.Assert(entries[3].Timestamp.Equal(t1.Add(3*time.Second)), Equals, true)
+}
+
 func (s *CommitLogTestSuite) TestTrimLast(c *C) {
 	path := c.MkDir()
 
@@ -174,3 +207,978 @@ func (s *CommitLogTestSuite) TestTrimLast(c *C) {
 	c.Assert(len(clog.segments), Equals, 1)
 	c.Assert(upto.IsZero(), Equals, true)
 }
+
+func (s *CommitLogTestSuite) TestTrimEntryCount(c *C) {
+	path := c.MkDir()
+
+	opts := Options{
+		Path:            path,
+		MaxSegmentBytes: 80,
+		CleanerOptions: CleanerOptions{
+			"Name":       "EntryCount",
+			"MaxEntries": "7",
+		},
+	}
+	clog, err := New(opts)
+	if err != nil {
+		c.Fatal(err)
+	}
+	t1 := time.Now().UTC()
+	for i := 0; i < 12; i++ {
+		entry := &Entry{
+			Timestamp: t1.Add(time.Duration(i) * time.Second),
+			Data:      []byte(strings.Repeat("x", 10)),
+		}
+		if err := clog.Append(entry); err != nil {
+			c.Fatal(err)
+		}
+	}
+	c.Assert(len(clog.segments), Equals, 4)
+	count, err := clog.segments[0].EntryCount()
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int64(3))
+	clog.Close()
+
+	// the entries are counted from the files after reopen
+	clog, err = New(opts)
+	if err != nil {
+		c.Fatal(err)
+	}
+	upto, err := clog.Trim()
+	c.Assert(err, IsNil)
+	c.Assert(len(clog.segments), Equals, 2)
+	c.Assert(upto, Equals, t1.Add(6*time.Second))
+	c.Assert(len(readEntries(path, c)), Equals, 6)
+}
+
+func (s *CommitLogTestSuite) TestTrimComposite(c *C) {
+	path := c.MkDir()
+
+	clog, err := New(Options{
+		Path:            path,
+		MaxSegmentBytes: 80,
+		CleanerOptions: CleanerOptions{
+			"Name":        "Composite",
+			"Duration":    "1h",
+			"MaxLogBytes": "1000",
+			"MaxEntries":  "3",
+		},
+	})
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(len(clog.cleaner.(*CompositeCleaner).Cleaners), Equals, 3)
+
+	t1 := time.Now().Add(-5 * time.Hour).UTC()
+	t2 := time.Now().Add(-30 * time.Minute).UTC()
+	for _, t := range []time.Time{t1, t2, t2.Add(time.Minute)} {
+		for i := 0; i < 3; i++ {
+			entry := &Entry{
+				Timestamp: t.Add(time.Duration(i) * time.Second),
+				Data:      []byte(strings.Repeat("x", 10)),
+			}
+			if err := clog.Append(entry); err != nil {
+				c.Fatal(err)
+			}
+		}
+	}
+	c.Assert(len(clog.segments), Equals, 3)
+
+	// the first segment is too old, and the second one exceeds the count
+	upto, err := clog.Trim()
+	c.Assert(err, IsNil)
+	c.Assert(len(clog.segments), Equals, 1)
+	c.Assert(upto, Equals, t2.Add(time.Minute))
+}
+
+func (s *CommitLogTestSuite) TestSegmentSpan(c *C) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	offsets := []time.Duration{0, 30 * time.Minute, time.Hour, 70 * time.Minute, 3 * time.Hour}
+	entries := []*Entry{}
+	for _, offset := range offsets {
+		entries = append(entries, &Entry{
+			Timestamp: t0.Add(offset),
+			Data:      []byte("abc"),
+		})
+	}
+	expected := []int64{
+		t0.UnixNano(),
+		t0.Add(time.Hour).UnixNano(),
+		t0.Add(3 * time.Hour).UnixNano(),
+	}
+
+	for _, batch := range []bool{false, true} {
+		clog, err := New(Options{
+			Path:           c.MkDir(),
+			MaxSegmentSpan: time.Hour,
+		})
+		c.Assert(err, IsNil)
+		if batch {
+			c.Assert(clog.AppendBatch(entries), IsNil)
+		} else {
+			for _, entry := range entries {
+				c.Assert(clog.Append(entry), IsNil)
+			}
+		}
+		baseNanos := []int64{}
+		for _, segment := range clog.Segments() {
+			baseNanos = append(baseNanos, segment.BaseNano)
+		}
+		c.Assert(baseNanos, DeepEquals, expected)
+		c.Assert(len(readEntries(clog.Path, c)), Equals, len(entries))
+	}
+}
+
+func (s *CommitLogTestSuite) TestSegmentAge(c *C) {
+	clog, err := New(Options{
+		Path:          c.MkDir(),
+		MaxSegmentAge: 10 * time.Millisecond,
+	})
+	c.Assert(err, IsNil)
+	t0 := time.Now().UTC()
+	c.Assert(clog.Append(&Entry{Timestamp: t0, Data: []byte("abc")}), IsNil)
+	c.Assert(clog.Append(&Entry{Timestamp: t0.Add(time.Second), Data: []byte("abc")}), IsNil)
+	c.Assert(len(clog.segments), Equals, 1)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(clog.Append(&Entry{Timestamp: t0.Add(2 * time.Second), Data: []byte("abc")}), IsNil)
+	c.Assert(len(clog.segments), Equals, 2)
+
+	// the age is kept across restarts
+	path := c.MkDir()
+	opts := Options{Path: path, MaxSegmentAge: time.Hour}
+	clog, err = New(opts)
+	c.Assert(err, IsNil)
+	c.Assert(clog.Append(&Entry{Timestamp: t0, Data: []byte("abc")}), IsNil)
+	clog.Close()
+	clog, err = New(opts)
+	c.Assert(err, IsNil)
+	c.Assert(clog.Append(&Entry{Timestamp: t0.Add(time.Second), Data: []byte("abc")}), IsNil)
+	c.Assert(len(clog.segments), Equals, 1)
+	clog.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	filePath := filepath.Join(path, fmt.Sprintf(logNameFormat, t0.UnixNano()))
+	c.Assert(os.Chtimes(filePath, old, old), IsNil)
+	clog, err = New(opts)
+	c.Assert(err, IsNil)
+	c.Assert(clog.Append(&Entry{Timestamp: t0.Add(2 * time.Second), Data: []byte("abc")}), IsNil)
+	c.Assert(len(clog.segments), Equals, 2)
+}
+
+func (s *CommitLogTestSuite) TestCorruptRecord(c *C) {
+	path := c.MkDir()
+
+	clog, err := New(Options{Path: path})
+	if err != nil {
+		c.Fatal(err)
+	}
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	for i := 0; i < 2; i++ {
+		entry := &Entry{
+			Timestamp: t1.Add(time.Duration(i) * time.Second),
+			Data:      []byte(strings.Repeat("x", 10)),
+		}
+		if err := clog.Append(entry); err != nil {
+			c.Fatal(err)
+		}
+	}
+	clog.Close()
+
+	// flip a bit in the payload of the second record
+	filePath := filepath.Join(path, fmt.Sprintf(logNameFormat, t1.UnixNano()))
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		c.Fatal(err)
+	}
+	data[len(data)-1] ^= 0x01
+	if err := ioutil.WriteFile(filePath, data, 0666); err != nil {
+		c.Fatal(err)
+	}
+
+	reader, err := NewReader(path)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer reader.Close()
+	entry, err := reader.Read()
+	c.Assert(err, IsNil)
+	c.Assert(entry.Timestamp, Equals, t1)
+	entry, err = reader.Read()
+	c.Assert(entry, IsNil)
+	corruptErr, ok := err.(*CorruptRecordError)
+	c.Assert(ok, Equals, true)
+	c.Assert(corruptErr.Offset, Equals, int64(segmentHeaderLen+recordHeaderLen+10))
+	c.Assert(corruptErr.Reason, Equals, "checksum mismatch")
+}
+
+func (s *CommitLogTestSuite) TestLegacyFormat(c *C) {
+	path := c.MkDir()
+
+	// write a segment in the format without segment header and checksum
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	var data []byte
+	for i := 0; i < 2; i++ {
+		rec := make([]byte, legacyHeaderLen)
+		Encoding.PutUint64(rec[nanosecPos:], uint64(t1.Add(time.Duration(i)*time.Second).UnixNano()))
+		Encoding.PutUint32(rec[sizePos:], 3)
+		data = append(append(data, rec...), []byte("abc")...)
+	}
+	filePath := filepath.Join(path, fmt.Sprintf(logNameFormat, t1.UnixNano()))
+	if err := ioutil.WriteFile(filePath, data, 0666); err != nil {
+		c.Fatal(err)
+	}
+
+	clog, err := New(Options{Path: path})
+	if err != nil {
+		c.Fatal(err)
+	}
+	t2 := t1.Add(time.Minute)
+	if err := clog.Append(&Entry{Timestamp: t2, Data: []byte("def")}); err != nil {
+		c.Fatal(err)
+	}
+	// the legacy segment is not appended to
+	c.Assert(len(clog.segments), Equals, 2)
+	c.Assert(clog.segments[0].version, Equals, formatLegacy)
+	c.Assert(clog.segments[1].version, Equals, currentFormat)
+	clog.Close()
+
+	results := readEntries(path, c)
+	c.Assert(len(results), Equals, 3)
+	c.Assert(results[1].Timestamp, Equals, t1.Add(time.Second))
+	c.Assert(string(results[1].Data), Equals, "abc")
+	c.Assert(results[2].Timestamp, Equals, t2)
+	c.Assert(string(results[2].Data), Equals, "def")
+}
+
+func (s *CommitLogTestSuite) TestOffsets(c *C) {
+	path := c.MkDir()
+
+	// write a segment in the v1 format without offsets
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	data := newSegmentHeader(formatV1)
+	for i := 0; i < 2; i++ {
+		rec := make([]byte, v1RecordHeaderLen)
+		Encoding.PutUint64(rec[nanosecPos:], uint64(t1.Add(time.Duration(i)*time.Second).UnixNano()))
+		Encoding.PutUint32(rec[sizePos:], 3)
+		Encoding.PutUint32(rec[v1CrcPos:], recordChecksum(rec[:v1CrcPos], []byte("abc")))
+		data = append(append(data, rec...), []byte("abc")...)
+	}
+	filePath := filepath.Join(path, fmt.Sprintf(logNameFormat, t1.UnixNano()))
+	c.Assert(ioutil.WriteFile(filePath, data, 0666), IsNil)
+
+	// the offsets continue from the number of the existing entries
+	clog, err := New(Options{Path: path, MaxSegmentBytes: 80})
+	c.Assert(err, IsNil)
+	c.Assert(clog.NextOffset(), Equals, int64(2))
+	entries := []*Entry{}
+	for i := 2; i < 8; i++ {
+		entries = append(entries, &Entry{
+			Timestamp: t1.Add(time.Duration(i) * time.Second),
+			Data:      []byte(fmt.Sprintf("%02d", i)),
+		})
+	}
+	c.Assert(clog.Append(entries[0]), IsNil)
+	c.Assert(entries[0].Offset, Equals, int64(2))
+	c.Assert(clog.AppendBatch(entries[1:]), IsNil)
+	c.Assert(entries[5].Offset, Equals, int64(7))
+	c.Assert(clog.NextOffset(), Equals, int64(8))
+
+	// the offsets are reused after a rollback
+	pos := clog.Tell()
+	c.Assert(clog.Append(&Entry{Timestamp: t1.Add(8 * time.Second), Data: []byte("08")}), IsNil)
+	c.Assert(clog.Truncate(pos), IsNil)
+	c.Assert(clog.NextOffset(), Equals, int64(8))
+	clog.Close()
+
+	results := readEntries(path, c)
+	c.Assert(len(results), Equals, 8)
+	c.Assert(results[1].Offset, Equals, int64(0))
+	for i := 2; i < 8; i++ {
+		c.Assert(results[i].Offset, Equals, int64(i))
+	}
+
+	// the next offset is restored on open
+	clog, err = New(Options{Path: path})
+	c.Assert(err, IsNil)
+	c.Assert(clog.NextOffset(), Equals, int64(8))
+	c.Assert(len(clog.segments) > 2, Equals, true)
+	clog.Close()
+
+	reader, err := NewReader(path)
+	c.Assert(err, IsNil)
+	defer reader.Close()
+	c.Assert(reader.SeekOffset(5), IsNil)
+	c.Assert(reader.currentSegment > 0, Equals, true)
+	entry, err := reader.Read()
+	c.Assert(err, IsNil)
+	c.Assert(entry.Offset, Equals, int64(5))
+
+	result, err := Verify(path, RepairNone, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(result.Problems), Equals, 0)
+}
+
+func (s *CommitLogTestSuite) TestLateEntries(c *C) {
+	path := c.MkDir()
+
+	clog, err := New(Options{Path: path, MaxSegmentBytes: 80, IndexIntervalBytes: 1})
+	c.Assert(err, IsNil)
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 0, time.UTC)
+	at := func(msec int) time.Time {
+		return t1.Add(time.Duration(msec) * time.Millisecond)
+	}
+	for i := 0; i < 6; i++ {
+		c.Assert(clog.Append(&Entry{Timestamp: at(i * 1000), Data: []byte(fmt.Sprintf("%02d", i))}), IsNil)
+	}
+	// the late entry starts a new segment named after the latest timestamp
+	c.Assert(clog.AppendBatch([]*Entry{
+		{Timestamp: at(2500), Data: []byte("2h")},
+		{Timestamp: at(3000), Data: []byte("R3"), Replace: true},
+	}), IsNil)
+	c.Assert(clog.activeSegment().BaseNano, Equals, at(5000).UnixNano())
+	last, err := clog.LastTimestamp()
+	c.Assert(err, IsNil)
+	c.Assert(last.Equal(at(5000)), Equals, true)
+	c.Assert(clog.Append(&Entry{Timestamp: at(6000), Data: []byte("06")}), IsNil)
+	clog.Close()
+
+	// the latest timestamp is restored on open
+	clog, err = New(Options{Path: path, MaxSegmentBytes: 80, IndexIntervalBytes: 1})
+	c.Assert(err, IsNil)
+	c.Assert(clog.Append(&Entry{Timestamp: at(1500), Data: []byte("1h")}), IsNil)
+	clog.Close()
+
+	results := readEntries(path, c)
+	c.Assert(len(results), Equals, 10)
+	for i, result := range results {
+		late := i == 6 || i == 7 || i == 9
+		c.Assert(result.late, Equals, late, Commentf("entry %d", i))
+		c.Assert(result.Replace, Equals, i == 7, Commentf("entry %d", i))
+	}
+
+	read := func(reader *Reader) []string {
+		defer reader.Close()
+		results := []string{}
+		for {
+			entry, err := reader.Read()
+			c.Assert(err, IsNil)
+			if entry == nil {
+				return results
+			}
+			results = append(results, string(entry.Data))
+		}
+	}
+	from, to := at(2000), at(3000)
+	for _, t := range []struct {
+		lateness time.Duration
+		expected []string
+	}{
+		{0, []string{"02", "03"}},
+		{3 * time.Second, []string{"02", "03", "2h", "R3"}},
+		{-1, []string{"02", "03", "2h", "R3"}},
+	} {
+		reader, err := NewReaderRange(path, &from, &to)
+		c.Assert(err, IsNil)
+		reader.Lateness = t.lateness
+		c.Assert(read(reader), DeepEquals, t.expected)
+	}
+	// the index lookup does not skip the late entries after the position
+	reader, err := NewReaderFrom(path, at(2700))
+	c.Assert(err, IsNil)
+	c.Assert(read(reader), DeepEquals, []string{"03", "04", "05", "R3", "06"})
+
+	result, err := Verify(path, RepairNone, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(result.Problems), Equals, 0)
+}
+
+func (s *CommitLogTestSuite) TestLateEntryFullSegment(c *C) {
+	path := c.MkDir()
+	opts := Options{
+		Path:            path,
+		MaxSegmentBytes: 1,
+		CleanerOptions:  CleanerOptions{"Name": "Duration", "Duration": "1h"},
+	}
+	clog, err := New(opts)
+	c.Assert(err, IsNil)
+	t1 := time.Now().Add(-time.Minute).Round(time.Second)
+	c.Assert(clog.Append(&Entry{Timestamp: t1, Data: []byte("01")}), IsNil)
+	c.Assert(clog.activeSegment().IsFull(), Equals, true)
+	// the late entry and the one of the same timestamp go to new segments
+	// instead of the files of the full ones
+	c.Assert(clog.Append(&Entry{Timestamp: t1.Add(-time.Second), Data: []byte("00")}), IsNil)
+	c.Assert(clog.Append(&Entry{Timestamp: t1.Add(time.Millisecond), Data: []byte("02")}), IsNil)
+	c.Assert(clog.Append(&Entry{Timestamp: t1.Add(time.Millisecond), Data: []byte("03")}), IsNil)
+	c.Assert(len(clog.segments), Equals, 4)
+	for i := 1; i < len(clog.segments); i++ {
+		c.Assert(clog.segments[i].BaseNano > clog.segments[i-1].BaseNano, Equals, true)
+	}
+	_, err = clog.Trim()
+	c.Assert(err, IsNil)
+	c.Assert(clog.Truncate(clog.Tell()), IsNil)
+	clog.Close()
+
+	results := readEntries(path, c)
+	c.Assert(len(results), Equals, 4)
+	for i, data := range []string{"01", "00", "02", "03"} {
+		c.Assert(string(results[i].Data), Equals, data)
+	}
+	result, err := Verify(path, RepairNone, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(result.Problems), Equals, 0)
+}
+
+func (s *CommitLogTestSuite) TestRecoverTornTail(c *C) {
+	path := c.MkDir()
+
+	clog, err := New(Options{Path: path})
+	if err != nil {
+		c.Fatal(err)
+	}
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	if err := clog.Append(&Entry{Timestamp: t1, Data: []byte("abc")}); err != nil {
+		c.Fatal(err)
+	}
+	size := clog.Tell().offset
+	clog.Close()
+
+	// simulate a crash in the middle of writing the second record
+	filePath := filepath.Join(path, fmt.Sprintf(logNameFormat, t1.UnixNano()))
+	rec := NewRecord(t1.Add(time.Second).UnixNano(), 1, []byte("defghi"))
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		c.Fatal(err)
+	}
+	file.Write(rec[:len(rec)-2])
+	file.Close()
+
+	clog, err = New(Options{Path: path})
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(clog.Tell().offset, Equals, size)
+	fi, err := os.Stat(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, size)
+
+	t2 := t1.Add(2 * time.Second)
+	if err := clog.Append(&Entry{Timestamp: t2, Data: []byte("jkl")}); err != nil {
+		c.Fatal(err)
+	}
+	clog.Close()
+
+	results := readEntries(path, c)
+	c.Assert(len(results), Equals, 2)
+	c.Assert(results[0].Timestamp, Equals, t1)
+	c.Assert(results[1].Timestamp, Equals, t2)
+	c.Assert(string(results[1].Data), Equals, "jkl")
+}
+
+func (s *CommitLogTestSuite) TestIndex(c *C) {
+	path := c.MkDir()
+
+	clog, err := New(Options{
+		Path:               path,
+		MaxSegmentBytes:    4096,
+		IndexIntervalBytes: 100,
+	})
+	if err != nil {
+		c.Fatal(err)
+	}
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	for i := 0; i < 20; i++ {
+		entry := &Entry{
+			Timestamp: t1.Add(time.Duration(i) * time.Second),
+			Data:      []byte(strings.Repeat("x", 25)),
+		}
+		if err := clog.Append(entry); err != nil {
+			c.Fatal(err)
+		}
+	}
+	c.Assert(len(clog.segments), Equals, 1)
+	segment := clog.segments[0]
+	// every other record of 50 bytes is indexed
+	c.Assert(len(segment.index.entries), Equals, 10)
+
+	last, err := segment.LastTimestamp()
+	c.Assert(err, IsNil)
+	c.Assert(last, Equals, t1.Add(19*time.Second))
+	pos, err := segment.StartPosition(t1.Add(5 * time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(pos, Equals, int64(segmentHeaderLen+4*50))
+	clog.Close()
+
+	// missing index is rebuilt on load
+	indexPath := filepath.Join(path, fmt.Sprintf(indexNameFormat, t1.UnixNano()))
+	c.Assert(os.Remove(indexPath), IsNil)
+	clog, err = New(Options{Path: path, IndexIntervalBytes: 100})
+	c.Assert(err, IsNil)
+	last, err = clog.segments[0].LastTimestamp()
+	c.Assert(err, IsNil)
+	c.Assert(last, Equals, t1.Add(19*time.Second))
+	c.Assert(len(clog.segments[0].index.entries), Equals, 10)
+
+	// stale index is rebuilt after truncation
+	pos1 := &position{segment: clog.segments[0], offset: int64(segmentHeaderLen + 15*50)}
+	c.Assert(clog.Truncate(pos1), IsNil)
+	clog.Close()
+	clog, err = New(Options{Path: path, IndexIntervalBytes: 100})
+	c.Assert(err, IsNil)
+	last, err = clog.segments[0].LastTimestamp()
+	c.Assert(err, IsNil)
+	c.Assert(last, Equals, t1.Add(14*time.Second))
+	c.Assert(len(clog.segments[0].index.entries), Equals, 8)
+	clog.Close()
+}
+
+func (s *CommitLogTestSuite) TestReaderRange(c *C) {
+	path := c.MkDir()
+
+	clog, err := New(Options{
+		Path:               path,
+		MaxSegmentBytes:    100,
+		IndexIntervalBytes: 50,
+	})
+	if err != nil {
+		c.Fatal(err)
+	}
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	for i := 0; i < 20; i++ {
+		entry := &Entry{
+			Timestamp: t1.Add(time.Duration(i) * time.Second),
+			Data:      []byte(fmt.Sprintf("%02d", i)),
+		}
+		if err := clog.Append(entry); err != nil {
+			c.Fatal(err)
+		}
+	}
+	c.Assert(len(clog.segments) > 2, Equals, true)
+	clog.Close()
+
+	read := func(reader *Reader) []*Entry {
+		defer reader.Close()
+		results := []*Entry{}
+		for {
+			entry, err := reader.Read()
+			c.Assert(err, IsNil)
+			if entry == nil {
+				return results
+			}
+			results = append(results, entry)
+		}
+	}
+
+	reader, err := NewReaderFrom(path, t1.Add(12*time.Second))
+	c.Assert(err, IsNil)
+	results := read(reader)
+	c.Assert(len(results), Equals, 8)
+	c.Assert(string(results[0].Data), Equals, "12")
+
+	from := t1.Add(3*time.Second + time.Millisecond)
+	to := t1.Add(15 * time.Second)
+	reader, err = NewReaderRange(path, &from, &to)
+	c.Assert(err, IsNil)
+	results = read(reader)
+	c.Assert(len(results), Equals, 12)
+	c.Assert(string(results[0].Data), Equals, "04")
+	c.Assert(string(results[11].Data), Equals, "15")
+
+	// out of range
+	reader, err = NewReaderFrom(path, t1.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(len(read(reader)), Equals, 0)
+	to = t1.Add(-time.Hour)
+	reader, err = NewReaderRange(path, nil, &to)
+	c.Assert(err, IsNil)
+	c.Assert(len(read(reader)), Equals, 0)
+}
+
+func (s *CommitLogTestSuite) TestFollow(c *C) {
+	path := c.MkDir()
+
+	clog, err := New(Options{
+		Path:            path,
+		MaxSegmentBytes: 80,
+		CleanerOptions:  CleanerOptions{"MaxLogBytes": "100"},
+	})
+	if err != nil {
+		c.Fatal(err)
+	}
+	reader, err := NewReader(path)
+	c.Assert(err, IsNil)
+	defer reader.Close()
+	reader.PollInterval = time.Millisecond
+
+	entry, err := reader.Poll()
+	c.Assert(err, IsNil)
+	c.Assert(entry, IsNil)
+
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	appendEntry := func(i int) {
+		err := clog.Append(&Entry{
+			Timestamp: t1.Add(time.Duration(i) * time.Second),
+			Data:      []byte(fmt.Sprintf("%02d", i)),
+		})
+		c.Assert(err, IsNil)
+	}
+
+	// new records in the same segment
+	appendEntry(0)
+	appendEntry(1)
+	for i := 0; i < 2; i++ {
+		entry, err = reader.Poll()
+		c.Assert(err, IsNil)
+		c.Assert(string(entry.Data), Equals, fmt.Sprintf("%02d", i))
+	}
+	entry, err = reader.Poll()
+	c.Assert(err, IsNil)
+	c.Assert(entry, IsNil)
+
+	// a torn record at the tail is read after it is completed
+	rec := NewRecord(t1.Add(2*time.Second).UnixNano(), 2, []byte("02"))
+	active := clog.activeSegment()
+	c.Assert(active.ensureOpen(true), IsNil)
+	_, err = active.file.Write(rec[:5])
+	c.Assert(err, IsNil)
+	entry, err = reader.Poll()
+	c.Assert(err, IsNil)
+	c.Assert(entry, IsNil)
+	_, err = active.file.Write(rec[5:])
+	c.Assert(err, IsNil)
+	active.Size += int64(len(rec))
+	entry, err = reader.Poll()
+	c.Assert(err, IsNil)
+	c.Assert(string(entry.Data), Equals, "02")
+
+	// rolled over to new segments, some of which are deleted before read
+	for i := 3; i < 12; i++ {
+		appendEntry(i)
+	}
+	entry, err = reader.Poll()
+	c.Assert(err, IsNil)
+	c.Assert(string(entry.Data), Equals, "03")
+	_, err = clog.Trim()
+	c.Assert(err, IsNil)
+	c.Assert(len(clog.segments) < len(reader.clog.segments), Equals, true)
+
+	done := make(chan struct{})
+	results := []string{}
+	for {
+		entry, err := reader.Next(done)
+		c.Assert(err, IsNil)
+		results = append(results, string(entry.Data))
+		if string(entry.Data) == "11" {
+			break
+		}
+	}
+	// the segment of 06-08 was deleted before the reader got to it
+	c.Assert(results, DeepEquals, []string{"04", "05", "09", "10", "11"})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		appendEntry(12)
+	}()
+	entry, err = reader.Next(done)
+	c.Assert(err, IsNil)
+	c.Assert(string(entry.Data), Equals, "12")
+
+	close(done)
+	entry, err = reader.Next(done)
+	c.Assert(err, IsNil)
+	c.Assert(entry, IsNil)
+}
+
+func (s *CommitLogTestSuite) TestSyncPolicy(c *C) {
+	_, err := New(Options{Path: c.MkDir(), SyncPolicy: "sometimes"})
+	c.Assert(err, NotNil)
+	_, err = New(Options{Path: c.MkDir(), SyncPolicy: SyncInterval})
+	c.Assert(err, NotNil)
+
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	entry := &Entry{Timestamp: t1, Data: []byte("abc")}
+
+	clog, err := New(Options{Path: c.MkDir(), SyncPolicy: SyncAlways})
+	c.Assert(err, IsNil)
+	c.Assert(clog.Append(entry), IsNil)
+	c.Assert(clog.dirty, Equals, false)
+	clog.Close()
+
+	clog, err = New(Options{Path: c.MkDir(), SyncPolicy: SyncBatch})
+	c.Assert(err, IsNil)
+	c.Assert(clog.Append(entry), IsNil)
+	c.Assert(clog.dirty, Equals, true)
+	c.Assert(clog.Commit(), IsNil)
+	c.Assert(clog.dirty, Equals, false)
+	clog.Close()
+
+	clog, err = New(Options{Path: c.MkDir(), SyncPolicy: SyncInterval, SyncInterval: time.Hour})
+	c.Assert(err, IsNil)
+	c.Assert(clog.Append(entry), IsNil)
+	c.Assert(clog.Commit(), IsNil)
+	c.Assert(clog.dirty, Equals, false)
+	c.Assert(clog.Append(entry), IsNil)
+	c.Assert(clog.Commit(), IsNil)
+	c.Assert(clog.dirty, Equals, true)
+	clog.Close()
+
+	clog, err = New(Options{Path: c.MkDir()})
+	c.Assert(err, IsNil)
+	c.Assert(clog.SyncPolicy, Equals, SyncNone)
+	c.Assert(clog.Append(entry), IsNil)
+	c.Assert(clog.Commit(), IsNil)
+	c.Assert(clog.dirty, Equals, true)
+	clog.Close()
+}
+
+func (s *CommitLogTestSuite) TestSyncFailure(c *C) {
+	defer func(sync func(*os.File) error) {
+		syncFile = sync
+	}(syncFile)
+	path := c.MkDir()
+	clog, err := New(Options{Path: path, SyncPolicy: SyncAlways})
+	c.Assert(err, IsNil)
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	c.Assert(clog.AppendBatch([]*Entry{{Timestamp: t1, Data: []byte("00")}}), IsNil)
+
+	// the entries are truncated back if the sync fails
+	syncFile = func(*os.File) error { return fmt.Errorf("disk failure") }
+	err = clog.AppendBatch([]*Entry{
+		{Timestamp: t1.Add(time.Second), Data: []byte("01")},
+		{Timestamp: t1.Add(2 * time.Second), Data: []byte("02")},
+	})
+	c.Assert(err, ErrorMatches, ".*disk failure")
+	c.Assert(clog.NextOffset(), Equals, int64(1))
+	err = clog.Append(&Entry{Timestamp: t1.Add(time.Second), Data: []byte("01")})
+	c.Assert(err, ErrorMatches, ".*disk failure")
+	c.Assert(clog.NextOffset(), Equals, int64(1))
+
+	syncFile = (*os.File).Sync
+	entries := []*Entry{{Timestamp: t1.Add(time.Second), Data: []byte("01")}}
+	c.Assert(clog.AppendBatch(entries), IsNil)
+	c.Assert(entries[0].Offset, Equals, int64(1))
+	clog.Close()
+	results := readEntries(path, c)
+	c.Assert(len(results), Equals, 2)
+	c.Assert(string(results[1].Data), Equals, "01")
+}
+
+func (s *CommitLogTestSuite) TestAppendBatch(c *C) {
+	path := c.MkDir()
+
+	clog, err := New(Options{
+		Path:               path,
+		MaxSegmentBytes:    140,
+		IndexIntervalBytes: 60,
+	})
+	if err != nil {
+		c.Fatal(err)
+	}
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	entries := []*Entry{}
+	for i := 0; i < 12; i++ {
+		entries = append(entries, &Entry{
+			Timestamp: t1.Add(time.Duration(i) * time.Second),
+			Data:      []byte(fmt.Sprintf("%02d", i)),
+		})
+	}
+	c.Assert(clog.AppendBatch(entries[:2]), IsNil)
+	c.Assert(clog.AppendBatch(entries[2:]), IsNil)
+	// 5 records of 27 bytes fit in a segment, as Append does
+	c.Assert(len(clog.segments), Equals, 3)
+	c.Assert(clog.segments[1].BaseNano, Equals, t1.Add(5*time.Second).UnixNano())
+	c.Assert(len(clog.segments[0].index.entries), Equals, 2)
+	pos := clog.Tell()
+	clog.Close()
+
+	results := readEntries(path, c)
+	c.Assert(len(results), Equals, 12)
+	for i, entry := range results {
+		c.Assert(entry.Timestamp, Equals, entries[i].Timestamp)
+		c.Assert(string(entry.Data), Equals, string(entries[i].Data))
+	}
+
+	// roll back on failure
+	more := []*Entry{}
+	for i := 12; i < 20; i++ {
+		more = append(more, &Entry{
+			Timestamp: t1.Add(time.Duration(i) * time.Second),
+			Data:      []byte(fmt.Sprintf("%02d", i)),
+		})
+	}
+	// the segment file starting from the 15th entry cannot be created
+	blocker := filepath.Join(path, fmt.Sprintf(logNameFormat, more[3].Timestamp.UnixNano()))
+	c.Assert(os.Mkdir(blocker, 0755), IsNil)
+	err = clog.AppendBatch(more)
+	c.Assert(err, NotNil)
+	c.Assert(os.Remove(blocker), IsNil)
+	c.Assert(len(clog.segments), Equals, 3)
+	c.Assert(clog.Tell().offset, Equals, pos.offset)
+	c.Assert(len(readEntries(path, c)), Equals, 12)
+}
+
+func (s *CommitLogTestSuite) TestCompression(c *C) {
+	path := c.MkDir()
+
+	_, err := New(Options{Path: c.MkDir(), Codec: "zip"})
+	c.Assert(err, NotNil)
+	_, err = New(Options{Path: c.MkDir(), Codec: "zstd"})
+	c.Assert(err, ErrorMatches, "codec zstd is not supported yet.*")
+
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	payload := strings.Repeat(`{"bid":1.23,"ask":1.24}`, 20)
+	i := 0
+	for _, codec := range []Codec{CodecGzip, CodecSnappy, CodecNone} {
+		clog, err := New(Options{Path: path, Codec: codec})
+		c.Assert(err, IsNil)
+		// a short payload is stored uncompressed
+		for _, data := range []string{payload, "x"} {
+			err := clog.Append(&Entry{
+				Timestamp: t1.Add(time.Duration(i) * time.Second),
+				Data:      []byte(data),
+			})
+			c.Assert(err, IsNil)
+			i++
+		}
+		clog.Close()
+	}
+
+	results := readEntries(path, c)
+	c.Assert(len(results), Equals, 6)
+	for i, entry := range results {
+		c.Assert(entry.Timestamp, Equals, t1.Add(time.Duration(i)*time.Second))
+		if i%2 == 0 {
+			c.Assert(string(entry.Data), Equals, payload)
+		} else {
+			c.Assert(string(entry.Data), Equals, "x")
+		}
+	}
+
+	fi, err := os.Stat(filepath.Join(path, fmt.Sprintf(logNameFormat, t1.UnixNano())))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size() < int64(len(payload)*2), Equals, true)
+}
+
+func (s *CommitLogTestSuite) TestEntryIDs(c *C) {
+	path := c.MkDir()
+
+	clog, err := New(Options{Path: path, MaxSegmentBytes: 100, Codec: CodecGzip})
+	c.Assert(err, IsNil)
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	payload := strings.Repeat(`{"bid":1.23,"ask":1.24}`, 20)
+	for i := 0; i < 8; i++ {
+		entry := &Entry{
+			Timestamp: t1.Add(time.Duration(i) * time.Second),
+			Data:      []byte(payload),
+		}
+		if i%4 != 3 {
+			entry.ID = fmt.Sprintf("msg-%d", i)
+		}
+		c.Assert(clog.Append(entry), IsNil)
+	}
+	c.Assert(len(clog.segments) > 2, Equals, true)
+
+	ids, err := clog.LastIDs(4)
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []string{"msg-4", "msg-5", "msg-6"})
+	ids, err = clog.LastIDs(10)
+	c.Assert(err, IsNil)
+	c.Assert(len(ids), Equals, 6)
+	// only the segments of the last entries are read
+	first := clog.segments[0].filePath
+	data, err := ioutil.ReadFile(first)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(first), IsNil)
+	ids, err = clog.LastIDs(2)
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []string{"msg-6"})
+	c.Assert(ioutil.WriteFile(first, data, 0666), IsNil)
+	clog.Close()
+
+	for i, entry := range readEntries(path, c) {
+		c.Assert(string(entry.Data), Equals, payload)
+		if i%4 != 3 {
+			c.Assert(entry.ID, Equals, fmt.Sprintf("msg-%d", i))
+		} else {
+			c.Assert(entry.ID, Equals, "")
+		}
+	}
+}
+
+func (s *CommitLogTestSuite) TestVerify(c *C) {
+	path := c.MkDir()
+	clog, err := New(Options{Path: path, MaxSegmentBytes: 40})
+	c.Assert(err, IsNil)
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	for i := 0; i < 3; i++ {
+		entry := &Entry{Timestamp: t1.Add(time.Duration(i) * time.Second), Data: []byte("abc")}
+		c.Assert(clog.Append(entry), IsNil)
+	}
+	clog.Close()
+	c.Assert(len(clog.segments), Equals, 2)
+
+	result, err := Verify(path, RepairNone, "")
+	c.Assert(err, IsNil)
+	c.Assert(result.Segments, Equals, 2)
+	c.Assert(result.Entries, Equals, int64(3))
+	c.Assert(len(result.Problems), Equals, 0)
+
+	// torn tail, stray file and out-of-order record in a misnamed segment
+	lastPath := clog.segments[1].filePath
+	file, err := os.OpenFile(lastPath, os.O_WRONLY|os.O_APPEND, 0666)
+	c.Assert(err, IsNil)
+	file.Write(NewRecord(t1.Add(time.Minute).UnixNano(), 3, []byte("abc"))[:10])
+	file.Close()
+	c.Assert(ioutil.WriteFile(filepath.Join(path, "garbage.tmp"), []byte("x"), 0666), IsNil)
+	misnamed := filepath.Join(path, fmt.Sprintf(logNameFormat, t1.Add(time.Hour).UnixNano()))
+	data := append(newSegmentHeader(currentFormat), NewRecord(t1.UnixNano(), 3, []byte("abc"))...)
+	c.Assert(ioutil.WriteFile(misnamed, data, 0666), IsNil)
+
+	result, err = Verify(path, RepairNone, "")
+	c.Assert(err, IsNil)
+	kinds := []ProblemKind{}
+	for _, problem := range result.Problems {
+		kinds = append(kinds, problem.Kind)
+	}
+	c.Assert(kinds, DeepEquals, []ProblemKind{ProblemCorrupt, ProblemBaseNano, ProblemOutOfOrder, ProblemStray})
+	c.Assert(result.Problems[0].Path, Equals, lastPath)
+	c.Assert(result.Problems[0].Offset, Equals, clog.segments[1].Size)
+
+	quarantineDir := c.MkDir()
+	result, err = Verify(path, RepairQuarantine, quarantineDir)
+	c.Assert(err, IsNil)
+	c.Assert(result.Problems[0].Repaired, Equals, true)
+	c.Assert(result.Problems[1].Repaired, Equals, false)
+	c.Assert(result.Problems[3].Repaired, Equals, true)
+	_, err = os.Stat(filepath.Join(quarantineDir, filepath.Base(lastPath)))
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(quarantineDir, "garbage.tmp"))
+	c.Assert(err, IsNil)
+}
+
+func (s *CommitLogTestSuite) TestVerifyTruncate(c *C) {
+	path := c.MkDir()
+	clog, err := New(Options{Path: path})
+	c.Assert(err, IsNil)
+	t1 := time.Date(2017, 8, 21, 16, 45, 13, 12, time.UTC)
+	c.Assert(clog.Append(&Entry{Timestamp: t1, Data: []byte("abc")}), IsNil)
+	size := clog.Tell().offset
+	clog.Close()
+
+	filePath := clog.segments[0].filePath
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0666)
+	c.Assert(err, IsNil)
+	file.Write(NewRecord(t1.Add(time.Second).UnixNano(), 1, []byte("abc"))[:15])
+	file.Close()
+
+	result, err := Verify(path, RepairTruncate, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(result.Problems), Equals, 1)
+	c.Assert(result.Problems[0].Repaired, Equals, true)
+	fi, err := os.Stat(filePath)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, size)
+
+	result, err = Verify(path, RepairNone, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(result.Problems), Equals, 0)
+	c.Assert(result.Entries, Equals, int64(1))
+}
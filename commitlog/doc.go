@@ -3,30 +3,78 @@ Package commitlog implements the append-only on-disk persistency layey.
 
 CommitLog is the on-disk persistency layer for Slait.  It is a simple append-only style format aiming
 the best performance for the use case.  The idea is borrowed from Kafka (and Jocko), but we further
-simpliy it to remove the index file assuming the data is cached in the main memory.
+simpliy it assuming the data is cached in the main memory.
 
 Physical layout
 
-We assume every entry has timestamp and enforce entries to be ordered by the time in ascending
-order.  Each record is encoded as follows.
+We assume every entry has timestamp and expect entries to be ordered by the time in ascending
+order.  The late entries are appended as is and flagged, and they are left out of the index.  Each segment file starts with a header and each record is encoded as follows.
+
+Segment header:
+
+- byte 0-7: magic string "SLAITLOG"
+- byte 8: format version of the records in the segment (currently 2)
+
+Record:
 
 - byte 0-7: timestamp of the record in Unix epoch nano seconds
 - byte 8-11: the size of the payload
-- byte 12-: payload byte array
+- byte 12: attributes of the record
+- byte 13-20: offset of the record
+- byte 21-24: CRC-32C checksum of the byte 0-20 and the payload
+- byte 25-: payload byte array
+
+The offset is a sequence number of the record in the log, which increases by one for each
+appended record.  It is never reused unless the whole log is deleted, so the readers can
+tell exactly where they are and whether they have missed any record.
 
-The byte 0-7 and 8-11 are encoded in little endian.  There is no padding in between records.
+The lowest 3 bits of the attributes tell the compression codec of the payload: 0 for none,
+1 for gzip and 2 for snappy, while 3 is reserved for zstd, which is not supported yet.  Bit 3
+marks a late record, whose timestamp is older than a record before it, and bit 4 marks a record that replaces the records before it of the same timestamp.
+Bit 5 marks a record with the ID given by the producer, which is stored at the beginning of the
+payload after its length in uvarint.  The other bits are reserved.  The payload size and the checksum
+are of the compressed payload.  Since the codec is recorded per record, changing the codec
+of a log does not affect the existing records, and a record is stored uncompressed if the
+compression does not make it smaller.
+
+The numbers are encoded in little endian.  There is no padding in between records.
 Since the timestamp is encoded by Unix epoch nanoseconds, the maximum value for the timestamp is
 somewhere around the year 2262.  The timezone info will not be considered in the physical layout,
-and the restored time is always in UTC timezone.
+and the restored time is always in UTC timezone.  A torn record or a record whose checksum
+does not match is reported as CorruptRecordError on read.
+
+Segment files written by older versions have no header, and their records consist only of
+the timestamp (byte 0-7), the payload size (byte 8-11) and the payload (byte 12-).  The
+records of version 1 have no offset, and the checksum (byte 13-16) is followed by the payload
+(byte 17-).  The format is detected per segment, so such files are still readable, with the
+offset of the records reported as 0.  New records are never appended to them; a new segment
+is started instead, and the offsets start from the number of the existing records.
 
 Segment files
 
 A partition is split into segment files.  When the newest segment is full, new record is written
 into a new segment file.  A segment file is named after the base nanosecond from the first
-record in the file.  When a file is trimmed, the deletion happens only at the segment level.
-The maximum file size of the segment files are configured by the caller.
+record in the file, or the latest timestamp before it if the first record is late.  When a file is trimmed, the deletion happens only at the segment level.
+The maximum file size of the segment files are configured by the caller.  A new segment
+can also be started when the record timestamps span Options.MaxSegmentSpan from the first
+record, or when the segment has been written for Options.MaxSegmentAge, so that the
+retention works at a predictable granularity regardless of the data rate.
+When a commit log is opened for write, the last segment is scanned and the torn records
+left at its tail by a crash are truncated.
+
+Index files
+
+Optionally, each segment file has a sparse index file named after the same base nanosecond
+with the ".index" suffix.  The index file is a sequence of 16 byte entries, each of which
+consists of the timestamp of a record (byte 0-7) and its file offset in the segment file
+(byte 8-15).  The first record is always indexed, and the next record is indexed once it is
+at least Options.IndexIntervalBytes away from the last indexed one.  The index is used to
+find the last timestamp of a segment, or the position to start reading from,
+without scanning the whole segment.  It is rebuilt if it is missing or stale.
 
 The module does not have any concurrency protection.  The caller should take the appropriate
-action on use of this.
+action on use of this.  The exception is Reader, which may read the files written by another
+process.  Reader.Poll and Reader.Next follow the new records and segment files as they are
+written, and skip the segments deleted by the cleaner before they are read.
 */
 package commitlog
@@ -0,0 +1,213 @@
+package commitlog
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/alpacahq/slait/utils/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	IndexFileSuffix = ".index"
+	indexEntryLen   = 16
+)
+
+type indexEntry struct {
+	nanosec  int64
+	position int64
+}
+
+// index is the sparse timestamp index of a segment.  Each entry maps the
+// timestamp of a record to its file offset in the segment file.  The first
+// record is always indexed, and the following records are indexed when they
+// are at least indexInterval bytes away from the last indexed one.
+type index struct {
+	filePath string
+	entries  []indexEntry
+	file     *os.File
+}
+
+func (idx *index) read() error {
+	data, err := ioutil.ReadFile(idx.filePath)
+	if err != nil {
+		return err
+	}
+	if len(data)%indexEntryLen != 0 {
+		return errors.New("invalid index file size")
+	}
+	entries := make([]indexEntry, 0, len(data)/indexEntryLen)
+	for i := 0; i < len(data); i += indexEntryLen {
+		entries = append(entries, indexEntry{
+			nanosec:  int64(Encoding.Uint64(data[i : i+8])),
+			position: int64(Encoding.Uint64(data[i+8 : i+16])),
+		})
+	}
+	idx.entries = entries
+	return nil
+}
+
+// write rewrites the whole index file with the current entries.
+func (idx *index) write() error {
+	idx.close()
+	data := make([]byte, 0, len(idx.entries)*indexEntryLen)
+	for _, e := range idx.entries {
+		data = appendIndexEntry(data, e)
+	}
+	return ioutil.WriteFile(idx.filePath, data, 0666)
+}
+
+func (idx *index) append(e indexEntry) error {
+	if idx.file == nil {
+		file, err := os.OpenFile(idx.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return errors.Wrap(err, "open file failed")
+		}
+		idx.file = file
+	}
+	if _, err := idx.file.Write(appendIndexEntry(nil, e)); err != nil {
+		return errors.Wrap(err, "file write failed")
+	}
+	idx.entries = append(idx.entries, e)
+	return nil
+}
+
+// lookup returns the position of the last indexed record before nanosec,
+// or the first record if there is none.
+func (idx *index) lookup(nanosec int64) int64 {
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].nanosec >= nanosec
+	})
+	if i == 0 {
+		return idx.entries[0].position
+	}
+	return idx.entries[i-1].position
+}
+
+func (idx *index) close() {
+	if idx.file != nil {
+		idx.file.Close()
+		idx.file = nil
+	}
+}
+
+func appendIndexEntry(data []byte, e indexEntry) []byte {
+	var buf [indexEntryLen]byte
+	Encoding.PutUint64(buf[0:8], uint64(e.nanosec))
+	Encoding.PutUint64(buf[8:16], uint64(e.position))
+	return append(data, buf[:]...)
+}
+
+// ensureIndex loads the index of the segment.  The index file is rebuilt if it
+// is missing or stale and the segment maintains the index.  Returns nil if the
+// index is not available.
+func (s *Segment) ensureIndex() *index {
+	if s.index != nil || s.indexChecked {
+		return s.index
+	}
+	s.indexChecked = true
+	idx := &index{filePath: s.indexPath}
+	if err := idx.read(); err == nil && s.validIndex(idx) {
+		s.index = idx
+		return idx
+	}
+	if s.indexInterval <= 0 {
+		return nil
+	}
+	if err := s.rebuildIndex(idx); err != nil {
+		log.Warning("Failed to rebuild index %s: %v", s.indexPath, err)
+		return nil
+	}
+	s.index = idx
+	return idx
+}
+
+// validIndex checks if the index is consistent with the segment file.
+func (s *Segment) validIndex(idx *index) bool {
+	reader, err := s.openReader()
+	if err != nil {
+		return false
+	}
+	defer reader.file.Close()
+	if len(idx.entries) == 0 {
+		entry, err := reader.next()
+		return entry == nil && err == nil
+	}
+	// the first record is indexed unless it is late
+	if idx.entries[0].position < reader.pos {
+		return false
+	}
+	for i := 1; i < len(idx.entries); i++ {
+		if idx.entries[i].position <= idx.entries[i-1].position ||
+			idx.entries[i].nanosec < idx.entries[i-1].nanosec {
+			return false
+		}
+	}
+	last := idx.entries[len(idx.entries)-1]
+	if last.position >= s.Size {
+		return false
+	}
+	if err := reader.seek(last.position); err != nil {
+		return false
+	}
+	entry, err := reader.next()
+	return err == nil && entry != nil && entry.Timestamp.UnixNano() == last.nanosec
+}
+
+func (s *Segment) rebuildIndex(idx *index) error {
+	reader, err := s.openReader()
+	if err != nil {
+		return err
+	}
+	defer reader.file.Close()
+	idx.entries = nil
+	for {
+		pos := reader.pos
+		entry, err := reader.next()
+		if err != nil {
+			return err
+		} else if entry == nil {
+			break
+		}
+		n := len(idx.entries)
+		if !entry.late && (n == 0 || pos-idx.entries[n-1].position >= s.indexInterval) {
+			idx.entries = append(idx.entries, indexEntry{
+				nanosec:  entry.Timestamp.UnixNano(),
+				position: pos,
+			})
+		}
+	}
+	return idx.write()
+}
+
+// indexRecord adds the record at pos to the index if it is far enough from
+// the last indexed record.
+func (s *Segment) indexRecord(nanosec, pos int64) error {
+	idx := s.ensureIndex()
+	if idx == nil {
+		return nil
+	}
+	n := len(idx.entries)
+	if n > 0 && pos-idx.entries[n-1].position < s.indexInterval {
+		return nil
+	}
+	return idx.append(indexEntry{nanosec: nanosec, position: pos})
+}
+
+// truncateIndex removes the index entries at or after size.
+func (s *Segment) truncateIndex(size int64) error {
+	if s.index == nil {
+		// the index file is rebuilt on the next load
+		s.indexChecked = false
+		if err := os.Remove(s.indexPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	i := sort.Search(len(s.index.entries), func(i int) bool {
+		return s.index.entries[i].position >= size
+	})
+	s.index.entries = s.index.entries[:i]
+	return s.index.write()
+}
@@ -1,16 +1,33 @@
 package commitlog
 
-import ()
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultPollInterval = 100 * time.Millisecond
 
 type Reader struct {
 	filePath       string
 	currentSegment int
 	clog           *CommitLog
+	from           *time.Time
+	to             *time.Time
+	fromOffset     int64
+	done           bool
+	// PollInterval is the interval to check for new entries in Next.
+	PollInterval time.Duration
+	// Lateness is how far past the end of the range to look for the late
+	// entries within the range.  Negative reads to the end of the log.
+	Lateness time.Duration
 }
 
 func NewReader(path string) (*Reader, error) {
 	clog, err := New(Options{
-		Path: path,
+		Path:     path,
+		ReadOnly: true,
 	})
 	if err != nil {
 		return nil, err
@@ -20,25 +37,199 @@ func NewReader(path string) (*Reader, error) {
 		filePath:       path,
 		currentSegment: 0,
 		clog:           clog,
+		PollInterval:   defaultPollInterval,
 	}, nil
 }
 
-func (r *Reader) Read() (*Entry, error) {
+// NewReaderFrom returns a Reader that starts from the first entry at or after from.
+func NewReaderFrom(path string, from time.Time) (*Reader, error) {
+	return NewReaderRange(path, &from, nil)
+}
 
-	for {
+// NewReaderRange returns a Reader of the entries qualified by from and to, both
+// inclusive.  A nil bound means no bound.  The segments before from are skipped
+// by their base nanosec, and the index file is used to find the start position
+// in the segment if it is available.
+func NewReaderRange(path string, from, to *time.Time) (*Reader, error) {
+	r, err := NewReader(path)
+	if err != nil {
+		return nil, err
+	}
+	r.from = from
+	r.to = to
+	if from != nil {
+		if err := r.seek(*from); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// seek positions the reader to scan forward for the first entry at or after t.
+func (r *Reader) seek(t time.Time) error {
+	segments := r.clog.segments
+	nanosec := t.UnixNano()
+	// a segment can be skipped if the next one starts before t, since the
+	// records in it are all before the next base nanosec
+	for r.currentSegment < len(segments)-1 && segments[r.currentSegment+1].BaseNano < nanosec {
+		r.currentSegment++
+	}
+	if r.currentSegment >= len(segments) {
+		return nil
+	}
+	segment := segments[r.currentSegment]
+	pos, err := segment.StartPosition(t)
+	if err != nil {
+		return err
+	}
+	return segment.seek(pos)
+}
+
+// SeekOffset skips the entries before offset.  The segments whose next one
+// starts at or before offset are skipped as a whole.  The entries of the older
+// formats have no offset, so they are all skipped unless offset is 0.
+func (r *Reader) SeekOffset(offset int64) error {
+	r.fromOffset = offset
+	if offset <= 0 {
+		return nil
+	}
+	segments := r.clog.segments
+	for r.currentSegment < len(segments)-1 {
+		next := segments[r.currentSegment+1]
+		if next.version >= formatV2 {
+			first, err := next.firstEntry()
+			if err != nil && !os.IsNotExist(errors.Cause(err)) {
+				return err
+			}
+			// the segment deleted by the cleaner is skipped
+			if err == nil && (first == nil || first.Offset > offset) {
+				break
+			}
+		}
+		segments[r.currentSegment].Close()
+		r.currentSegment++
+	}
+	return nil
+}
+
+func (r *Reader) Read() (*Entry, error) {
+	for !r.done {
 		if r.currentSegment >= len(r.clog.segments) {
 			return nil, nil
 		}
-		entry, err := r.clog.segments[r.currentSegment].ReadEntry()
-		if entry == nil {
-			r.clog.segments[r.currentSegment].Close()
+		segment := r.clog.segments[r.currentSegment]
+		if r.to != nil && r.pastEnd(segment.BaseNano) {
+			r.done = true
+			break
+		}
+		entry, err := segment.ReadEntry()
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) && r.currentSegment < len(r.clog.segments)-1 {
+				// deleted by the cleaner before we got to it
+				r.currentSegment++
+				continue
+			}
+			return nil, err
+		} else if entry == nil {
+			if r.currentSegment == len(r.clog.segments)-1 {
+				// stay at the end of the last segment to pick up new records
+				return nil, nil
+			}
+			segment.Close()
 			r.currentSegment++
-		} else if err != nil {
+		} else if r.from != nil && entry.Timestamp.Before(*r.from) {
+			continue
+		} else if entry.Offset < r.fromOffset {
+			continue
+		} else if r.to != nil && entry.Timestamp.After(*r.to) {
+			r.done = r.pastEnd(entry.Timestamp.UnixNano())
+		} else {
+			return entry, err
+		}
+	}
+	return nil, nil
+}
+
+// pastEnd returns true if no entry in the range is after nanosec.
+func (r *Reader) pastEnd(nanosec int64) bool {
+	if r.Lateness < 0 {
+		return false
+	}
+	return nanosec > r.to.UnixNano()+int64(r.Lateness)
+}
+
+// Poll returns the next entry like Read, but it also picks up the records
+// appended and the segments created after the reader was opened, e.g. by
+// another process writing to the same directory.  It returns nil entry without
+// blocking if there is nothing new yet.
+func (r *Reader) Poll() (*Entry, error) {
+	for !r.done {
+		entry, err := r.Read()
+		if err != nil {
+			if _, ok := err.(*CorruptRecordError); !ok || r.currentSegment < len(r.clog.segments)-1 {
+				return nil, err
+			}
+			// the record may be in the middle of being written; read it again
+			// from the same position next time
+			segment := r.clog.segments[r.currentSegment]
+			if err := segment.seek(segment.reader.pos); err != nil {
+				return nil, err
+			}
+		} else if entry != nil {
+			return entry, nil
+		}
+		if updated, err := r.refresh(); err != nil || !updated {
 			return nil, err
-		} else if err == nil {
+		}
+	}
+	return nil, nil
+}
+
+// Next blocks until the next entry is available.  It returns nil entry if
+// done is closed before that.
+func (r *Reader) Next(done <-chan struct{}) (*Entry, error) {
+	for {
+		entry, err := r.Poll()
+		if entry != nil || err != nil || r.done {
 			return entry, err
 		}
+		select {
+		case <-done:
+			return nil, nil
+		case <-time.After(r.PollInterval):
+		}
+	}
+}
+
+// refresh loads the new segment files and the new size of the current
+// segment.  Returns true if there may be new entries to read.
+func (r *Reader) refresh() (bool, error) {
+	// New segments have to be listed before checking the current segment
+	// size, since the writer does not create a new segment file until it
+	// finishes writing to the previous one.
+	added, err := r.clog.loadSegments()
+	if err != nil {
+		return false, err
+	}
+	if r.currentSegment >= len(r.clog.segments) {
+		return added > 0, nil
+	}
+	segment := r.clog.segments[r.currentSegment]
+	fi, err := os.Stat(segment.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the open file is still readable if it is deleted by the cleaner
+			return added > 0, nil
+		}
+		return false, errors.Wrap(err, "file stat failed")
+	}
+	grown := fi.Size() > segment.Size
+	segment.Size = fi.Size()
+	if segment.reader != nil {
+		segment.reader.size = segment.Size
 	}
+	return grown || added > 0, nil
 }
 
 func (r *Reader) Close() error {
@@ -1,18 +1,267 @@
 package commitlog
 
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Segment format versions.  The version is stored in the segment header, except
+// for the legacy segments that were written before the header was introduced.
+const (
+	formatLegacy  byte = 0
+	formatV1      byte = 1
+	formatV2      byte = 2
+	currentFormat      = formatV2
+)
+
+const (
+	segmentMagic     = "SLAITLOG"
+	segmentHeaderLen = len(segmentMagic) + 1
+)
+
 const (
 	nanosecPos      = 0
 	sizePos         = 8
-	recordHeaderLen = 12
+	attributesPos   = 12
+	offsetPos       = 13
+	crcPos          = 21
+	legacyHeaderLen = 12
+	recordHeaderLen = 25
+	// the v1 records have no offset
+	v1CrcPos          = 13
+	v1RecordHeaderLen = 17
 )
 
+// The bits of the record attributes after the codec.
+const (
+	// attrLate marks a record older than a record before it in the log.
+	attrLate byte = 0x08
+	// attrReplace marks a record which replaces the records before it of the
+	// same timestamp.
+	attrReplace byte = 0x10
+	// attrID marks a record whose payload starts with the entry ID, prefixed
+	// with its length in uvarint.
+	attrID byte = 0x20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Record []byte
 
-func NewRecord(nanosec int64, payload []byte) Record {
-	rec := make([]byte, recordHeaderLen, recordHeaderLen+len(payload))
-	Encoding.PutUint64(rec[nanosecPos:nanosecPos+8], uint64(nanosec))
-	size := int32(len(payload))
-	Encoding.PutUint32(rec[sizePos:sizePos+4], uint32(size))
-	rec = append(rec, payload...)
-	return rec
+// NewRecord encodes the payload with its timestamp and offset in the current
+// record format.
+func NewRecord(nanosec, offset int64, payload []byte) Record {
+	return appendRecord(make([]byte, 0, recordHeaderLen+len(payload)), nanosec, offset, payload, CodecNone, 0)
+}
+
+// appendRecord encodes the record at the end of buf and returns the extended
+// buffer.  The payload is compressed with the codec, and flags are set to the
+// attributes.
+func appendRecord(buf []byte, nanosec, offset int64, payload []byte, codec Codec, flags byte) []byte {
+	data, attr := compress(codec, payload)
+	attr |= flags
+	var header [recordHeaderLen]byte
+	Encoding.PutUint64(header[nanosecPos:nanosecPos+8], uint64(nanosec))
+	size := int32(len(data))
+	Encoding.PutUint32(header[sizePos:sizePos+4], uint32(size))
+	header[attributesPos] = attr
+	Encoding.PutUint64(header[offsetPos:offsetPos+8], uint64(offset))
+	Encoding.PutUint32(header[crcPos:crcPos+4], recordChecksum(header[:crcPos], data))
+	buf = append(buf, header[:]...)
+	return append(buf, data...)
+}
+
+// recordChecksum computes the CRC-32C of the record header fields preceding
+// the checksum and the payload.
+func recordChecksum(header, payload []byte) uint32 {
+	crc := crc32.Checksum(header, crcTable)
+	return crc32.Update(crc, crcTable, payload)
+}
+
+// newSegmentHeader returns the header written at the beginning of a segment file.
+func newSegmentHeader(version byte) []byte {
+	return append([]byte(segmentMagic), version)
+}
+
+func recordHeaderSize(version byte) int {
+	switch version {
+	case formatLegacy:
+		return legacyHeaderLen
+	case formatV1:
+		return v1RecordHeaderLen
+	}
+	return recordHeaderLen
+}
+
+// checksumPos returns the position of the checksum in the record header, which
+// covers the header fields before it.
+func checksumPos(version byte) int {
+	if version == formatV1 {
+		return v1CrcPos
+	}
+	return crcPos
+}
+
+// CorruptRecordError is returned when a record in a segment file is torn or
+// fails the checksum verification.
+type CorruptRecordError struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record in %s at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+// recordReader decodes records sequentially from a segment file.
+type recordReader struct {
+	reader   *bufio.Reader
+	file     *os.File
+	filePath string
+	version  byte
+	// pos is the file offset of the next record
+	pos int64
+	// size is the known file size, or 0 if unknown
+	size   int64
+	header [recordHeaderLen]byte
+}
+
+// newRecordReader consumes the segment header from the file and returns
+// a reader positioned at the first record.
+func newRecordReader(file *os.File, filePath string, size int64) (*recordReader, error) {
+	r := &recordReader{
+		reader:   bufio.NewReader(file),
+		file:     file,
+		filePath: filePath,
+		size:     size,
+	}
+	version, headerLen, err := detectFormat(r.reader)
+	if err != nil {
+		return nil, err
+	}
+	r.version = version
+	r.pos = int64(headerLen)
+	return r, nil
+}
+
+// seek moves the reader to the record at the file offset.
+func (r *recordReader) seek(pos int64) error {
+	if _, err := r.file.Seek(pos, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek failed")
+	}
+	r.reader.Reset(r.file)
+	r.pos = pos
+	return nil
+}
+
+// next reads the next record.  It returns nil entry at the end of the file,
+// and *CorruptRecordError if the record is torn or its checksum does not match.
+func (r *recordReader) next() (*Entry, error) {
+	// re-use the buffer
+	header := r.header[:recordHeaderSize(r.version)]
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return nil, r.corrupted("truncated record header")
+		}
+		return nil, errors.Wrap(err, "error reading record header")
+	}
+	nanosec := int64(Encoding.Uint64(header[nanosecPos : nanosecPos+8]))
+	size := int64(int32(Encoding.Uint32(header[sizePos : sizePos+4])))
+	if size < 0 {
+		return nil, r.corrupted("invalid payload size")
+	}
+	if r.size > 0 && r.pos+int64(len(header))+size > r.size {
+		return nil, r.corrupted("truncated payload")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, r.corrupted("truncated payload")
+		}
+		return nil, errors.Wrap(err, "error reading payload")
+	}
+	offset := int64(0)
+	attr := byte(0)
+	if r.version != formatLegacy {
+		attr = header[attributesPos]
+		pos := checksumPos(r.version)
+		crc := Encoding.Uint32(header[pos : pos+4])
+		if recordChecksum(header[:pos], data) != crc {
+			return nil, r.corrupted("checksum mismatch")
+		}
+		if r.version >= formatV2 {
+			offset = int64(Encoding.Uint64(header[offsetPos : offsetPos+8]))
+		}
+		payload, err := decompress(header[attributesPos], data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error decoding record in %s at offset %d", r.filePath, r.pos)
+		}
+		data = payload
+	}
+	id := ""
+	if attr&attrID != 0 {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, r.corrupted("invalid entry ID")
+		}
+		id = string(data[n : n+int(length)])
+		data = data[n+int(length):]
+	}
+	r.pos += int64(len(header)) + size
+
+	return &Entry{
+		Timestamp: time.Unix(0, nanosec).UTC(),
+		Data:      data,
+		Offset:    offset,
+		Replace:   attr&attrReplace != 0,
+		ID:        id,
+		late:      attr&attrLate != 0,
+	}, nil
+}
+
+func (r *recordReader) corrupted(reason string) error {
+	return &CorruptRecordError{
+		Path:   r.filePath,
+		Offset: r.pos,
+		Reason: reason,
+	}
+}
+
+// detectFormat consumes the segment header from the reader if there is one and
+// returns the format version with the length of the consumed header.
+func detectFormat(reader *bufio.Reader) (byte, int, error) {
+	buf, err := reader.Peek(segmentHeaderLen)
+	if err != nil && err != io.EOF {
+		return 0, 0, errors.Wrap(err, "error reading segment header")
+	}
+	if !bytes.HasPrefix(buf, []byte(segmentMagic)) {
+		if len(buf) < len(segmentMagic) && bytes.HasPrefix([]byte(segmentMagic), buf) {
+			// torn segment header; there is no record in it
+			reader.Discard(len(buf))
+			return currentFormat, len(buf), nil
+		}
+		return formatLegacy, 0, nil
+	}
+	if len(buf) < segmentHeaderLen {
+		reader.Discard(len(buf))
+		return currentFormat, len(buf), nil
+	}
+	version := buf[len(segmentMagic)]
+	if version > currentFormat {
+		return 0, 0, errors.Errorf("unsupported segment format version %d", version)
+	}
+	reader.Discard(segmentHeaderLen)
+	return version, segmentHeaderLen, nil
 }
@@ -1,29 +1,48 @@
 package commitlog
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/alpacahq/slait/utils/log"
 	"github.com/pkg/errors"
 )
 
 const (
-	logNameFormat = "%020d.log"
+	logNameFormat   = "%020d.log"
+	indexNameFormat = "%020d.index"
 )
 
 type Segment struct {
-	file     *os.File
-	reader   io.Reader
-	filePath string
-	BaseNano int64
-	Size     int64
-	maxBytes int64
-	buf      *bytes.Buffer
+	file      *os.File
+	reader    *recordReader
+	filePath  string
+	indexPath string
+	BaseNano  int64
+	Size      int64
+	maxBytes  int64
+	// maxSpan is the maximum nanosec span of the record timestamps from
+	// BaseNano, and maxAge is the maximum wall-clock time to append to the
+	// segment since it is created.  No limit if 0.
+	maxSpan int64
+	maxAge  time.Duration
+	// created is when the segment file is created, or for an existing one,
+	// the earlier of its first record and its modification time, so that the
+	// age is kept across restarts
+	created time.Time
+	version byte
+	// indexInterval is the minimum number of bytes between the index entries.
+	// The index file is not maintained if it is 0.
+	indexInterval int64
+	index         *index
+	indexChecked  bool
+	// codec is used to compress the payload of the new records
+	codec Codec
+	// entryCount is the number of records in the first countedSize bytes
+	entryCount  int64
+	countedSize int64
 }
 
 func NewSegment(path string, baseNano int64, maxBytes int64) (*Segment, error) {
@@ -31,6 +50,7 @@ func NewSegment(path string, baseNano int64, maxBytes int64) (*Segment, error) {
 
 	fi, err := os.Stat(filePath)
 	size := int64(0)
+	created := time.Now()
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return nil, errors.Wrap(err, "file stat failed")
@@ -38,21 +58,58 @@ func NewSegment(path string, baseNano int64, maxBytes int64) (*Segment, error) {
 		err = nil
 	} else {
 		size = fi.Size()
+		created = fi.ModTime()
+		if first := time.Unix(0, baseNano); first.Before(created) {
+			created = first
+		}
 	}
 	// TODO sanity check for the first entry to have the consistent baseNano
 	s := &Segment{
-		file:     nil,
-		filePath: filePath,
-		maxBytes: maxBytes,
-		BaseNano: baseNano,
-		Size:     size,
+		file:      nil,
+		filePath:  filePath,
+		indexPath: filepath.Join(path, fmt.Sprintf(indexNameFormat, baseNano)),
+		maxBytes:  maxBytes,
+		BaseNano:  baseNano,
+		Size:      size,
+		created:   created,
+		version:   currentFormat,
+	}
+	if size > 0 {
+		if s.version, err = readFormat(filePath); err != nil {
+			return nil, err
+		}
 	}
 
 	return s, err
 }
 
+// readFormat detects the format version of an existing segment file.
+func readFormat(filePath string) (byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, errors.Wrap(err, "open file failed")
+	}
+	defer file.Close()
+	r, err := newRecordReader(file, filePath, 0)
+	if err != nil {
+		return 0, err
+	}
+	return r.version, nil
+}
+
+// IsFull returns true if no more records should be appended to the segment.
+// Legacy format segments are never appended to.
 func (s *Segment) IsFull() bool {
-	return s.Size >= s.maxBytes
+	if s.maxAge > 0 && time.Since(s.created) >= s.maxAge {
+		return true
+	}
+	return s.Size >= s.maxBytes || s.version != currentFormat
+}
+
+// accepts returns true if the record at nanosec is within the time span of
+// the segment.
+func (s *Segment) accepts(nanosec int64) bool {
+	return s.maxSpan <= 0 || nanosec-s.BaseNano < s.maxSpan
 }
 
 func (s *Segment) ensureOpen(forWrite bool) error {
@@ -69,72 +126,284 @@ func (s *Segment) ensureOpen(forWrite bool) error {
 		}
 		s.file = file
 
-		if !forWrite {
-			s.reader = bufio.NewReader(s.file)
+		if forWrite {
+			if s.Size == 0 {
+				header := newSegmentHeader(currentFormat)
+				if _, err := s.file.Write(header); err != nil {
+					s.file.Truncate(0)
+					return errors.Wrap(err, "file write failed")
+				}
+				s.version = currentFormat
+				s.Size = int64(len(header))
+			}
+		} else {
+			reader, err := newRecordReader(s.file, s.filePath, s.Size)
+			if err != nil {
+				return err
+			}
+			s.reader = reader
+			s.version = reader.version
 		}
 	}
 	return nil
 }
 
+// openReader opens a separate read handle of the segment file positioned at
+// the first record, so that the caller does not disturb the segment state.
+func (s *Segment) openReader() (*recordReader, error) {
+	file, err := os.Open(s.filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file failed")
+	}
+	reader, err := newRecordReader(file, s.filePath, s.Size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
 func (s *Segment) AppendEntry(entry *Entry) error {
+	_, err := s.AppendEntries([]*Entry{entry})
+	return err
+}
+
+// AppendEntries writes the entries to the segment in a single write until the
+// segment gets full or an entry is out of its time span.  The first entry is
+// always written.  Returns the number
+// of entries written.
+func (s *Segment) AppendEntries(entries []*Entry) (int, error) {
 	if err := s.ensureOpen(true); err != nil {
-		return err
+		return 0, err
+	}
+	bufLen := 0
+	for _, entry := range entries {
+		bufLen += recordHeaderLen + len(entry.Data)
+	}
+	buf := make([]byte, 0, bufLen)
+	positions := make([]int64, 0, len(entries))
+	size := s.Size
+	for i, entry := range entries {
+		if i > 0 && (size >= s.maxBytes || !s.accepts(entry.Timestamp.UnixNano())) {
+			break
+		}
+		positions = append(positions, size)
+		buf = appendRecord(buf, entry.Timestamp.UnixNano(), entry.Offset, entry.payload(), s.codec, entry.flags())
+		size = s.Size + int64(len(buf))
 	}
-	rec := NewRecord(entry.Timestamp.UnixNano(), entry.Data)
 
-	if written, err := s.file.Write(rec); err != nil {
-		if written != len(rec) {
+	if written, err := s.file.Write(buf); err != nil {
+		if written != len(buf) {
 			// truncate back to revert partial write
 			s.file.Truncate(s.Size)
 		}
-		return errors.Wrap(err, "file write failed")
-	} else {
-		s.Size += int64(written)
+		return 0, errors.Wrap(err, "file write failed")
 	}
-	return nil
+	if s.countedSize == s.Size {
+		s.entryCount += int64(len(positions))
+		s.countedSize = size
+	}
+	s.Size = size
+	if s.indexInterval > 0 {
+		for i, pos := range positions {
+			if entries[i].late {
+				// keep the index in the timestamp order
+				continue
+			}
+			if err := s.indexRecord(entries[i].Timestamp.UnixNano(), pos); err != nil {
+				// the index is rebuilt when it is loaded next time
+				log.Warning("Failed to update index %s: %v", s.indexPath, err)
+				break
+			}
+		}
+	}
+	return len(positions), nil
 }
 
+// Sync commits the written records to the disk.
+func (s *Segment) Sync() error {
+	if s.file == nil {
+		return nil
+	}
+	return syncFile(s.file)
+}
+
+// syncFile is replaced in the tests to simulate a failure.
+var syncFile = (*os.File).Sync
+
+// ReadEntry reads the next record from the segment.  It returns nil entry at
+// the end of the segment, and *CorruptRecordError if the record is torn or
+// its checksum does not match.
 func (s *Segment) ReadEntry() (*Entry, error) {
+	if s.reader != nil && s.reader.version != formatLegacy && s.reader.pos < int64(segmentHeaderLen) {
+		// the segment header was not written yet when opened; detect it again
+		s.Close()
+	}
 	if err := s.ensureOpen(false); err != nil {
 		return nil, err
 	}
+	return s.reader.next()
+}
 
-	// re-use the buffer
-	if s.buf == nil {
-		s.buf = &bytes.Buffer{}
-	} else {
-		s.buf.Reset()
+// seek moves the read position of the segment to the record at the file offset.
+func (s *Segment) seek(pos int64) error {
+	if err := s.ensureOpen(false); err != nil {
+		return err
+	}
+	return s.reader.seek(pos)
+}
+
+// LastTimestamp returns the latest timestamp of the records in the segment,
+// which is of the last record unless late records follow it.  Only the records
+// after the last index entry are read if the index is available.  A zero time
+// is returned if the segment is empty.
+func (s *Segment) LastTimestamp() (time.Time, error) {
+	_, latest, err := s.scanTail()
+	return latest, err
+}
+
+// lastEntry reads the last record in the segment, or returns nil if the
+// segment is empty.
+func (s *Segment) lastEntry() (*Entry, error) {
+	last, _, err := s.scanTail()
+	return last, err
+}
+
+// scanTail reads the records after the last index entry, and returns the last
+// one with the latest timestamp in the segment.  Since late records are not
+// indexed, the indexed record is the latest one up to it.
+func (s *Segment) scanTail() (*Entry, time.Time, error) {
+	reader, err := s.openReader()
+	if err != nil {
+		return nil, time.Time{}, err
 	}
-	if _, err := io.CopyN(s.buf, s.reader, recordHeaderLen); err != nil {
-		if err == io.EOF {
-			return nil, nil
+	defer reader.file.Close()
+	if idx := s.ensureIndex(); idx != nil && len(idx.entries) > 0 {
+		if err := reader.seek(idx.entries[len(idx.entries)-1].position); err != nil {
+			return nil, time.Time{}, err
 		}
-		return nil, errors.Wrap(err, "error reading nanosec")
 	}
-	nanosec := int64(Encoding.Uint64(s.buf.Bytes()[0:8]))
-	size := int32(Encoding.Uint32(s.buf.Bytes()[8:12]))
+	var (
+		last   *Entry
+		latest time.Time
+	)
+	for {
+		entry, err := reader.next()
+		if err != nil {
+			return nil, time.Time{}, err
+		} else if entry == nil {
+			return last, latest, nil
+		}
+		last = entry
+		if entry.Timestamp.After(latest) {
+			latest = entry.Timestamp
+		}
+	}
+}
+
+// firstEntry reads the first record in the segment, or returns nil if the
+// segment is empty.
+func (s *Segment) firstEntry() (*Entry, error) {
+	reader, err := s.openReader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.file.Close()
+	return reader.next()
+}
+
+// ids reads the IDs of the records at or after offset in the segment.  It also
+// returns true if the segment has a record before offset.
+func (s *Segment) ids(offset int64) ([]string, bool, error) {
+	reader, err := s.openReader()
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.file.Close()
+	ids := []string{}
+	before := false
+	for {
+		entry, err := reader.next()
+		if err != nil {
+			return nil, false, err
+		} else if entry == nil {
+			return ids, before, nil
+		}
+		if entry.Offset < offset {
+			before = true
+		} else if entry.ID != "" {
+			ids = append(ids, entry.ID)
+		}
+	}
+}
+
+// EntryCount returns the number of records in the segment.  Only the records
+// not counted yet are read.
+func (s *Segment) EntryCount() (int64, error) {
+	if s.countedSize == s.Size {
+		return s.entryCount, nil
+	}
+	reader, err := s.openReader()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.file.Close()
+	if s.countedSize > reader.pos {
+		if err := reader.seek(s.countedSize); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		entry, err := reader.next()
+		if err != nil {
+			return 0, err
+		} else if entry == nil {
+			break
+		}
+		s.entryCount++
+	}
+	s.countedSize = reader.pos
+	return s.entryCount, nil
+}
 
-	if _, err := io.CopyN(s.buf, s.reader, int64(size)); err != nil {
-		return nil, errors.Wrap(err, "error reading payload")
+// StartPosition returns the file offset to start scanning from in order to
+// find the first record at or after t.  The records before the offset are
+// all before t.
+func (s *Segment) StartPosition(t time.Time) (int64, error) {
+	if idx := s.ensureIndex(); idx != nil && len(idx.entries) > 0 {
+		pos := idx.lookup(t.UnixNano())
+		if pos == idx.entries[0].position {
+			// the late records before the first indexed one may be at or after t
+			pos = s.recordStart()
+		}
+		return pos, nil
 	}
+	reader, err := s.openReader()
+	if err != nil {
+		return 0, err
+	}
+	reader.file.Close()
+	return reader.pos, nil
+}
 
-	data := make([]byte, len(s.buf.Bytes()[12:]))
-	copy(data, s.buf.Bytes()[12:])
-	return &Entry{
-		Timestamp: time.Unix(0, nanosec).UTC(),
-		Data:      data,
-	}, nil
+// recordStart returns the file offset of the first record.
+func (s *Segment) recordStart() int64 {
+	if s.version == formatLegacy {
+		return 0
+	}
+	return int64(segmentHeaderLen)
 }
 
 func (s *Segment) Close() error {
+	if s.index != nil {
+		s.index.close()
+	}
 	if s.file != nil {
 		err := s.file.Close()
 		s.file = nil
+		s.reader = nil
 		return err
 	}
-	if s.buf != nil {
-		s.buf = nil
-	}
 	return nil
 }
 
@@ -145,6 +414,10 @@ func (s *Segment) Delete() error {
 	if err := os.Remove(s.filePath); err != nil {
 		return err
 	}
+	if err := os.Remove(s.indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.index = nil
 	return nil
 }
 
@@ -155,6 +428,11 @@ func (s *Segment) Truncate(size int64) error {
 	if err := s.file.Truncate(size); err != nil {
 		return err
 	}
+	s.Size = size
+	s.entryCount, s.countedSize = 0, 0
+	if err := s.truncateIndex(size); err != nil {
+		return err
+	}
 	// according to the doc, "The behavior of Seek on a file opened with O_APPEND is not specified."
 	// So, intead of seeking back to the truncate point, simply close it now
 	// and open it later again.
@@ -163,3 +441,39 @@ func (s *Segment) Truncate(size int64) error {
 	}
 	return nil
 }
+
+// recoverTail scans the segment and truncates the torn or corrupt records
+// after the last complete record.  Returns the number of bytes dropped.
+func (s *Segment) recoverTail() (int64, error) {
+	reader, err := s.openReader()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.file.Close()
+	validSize := reader.pos
+	if reader.version != formatLegacy && validSize < int64(segmentHeaderLen) {
+		// torn segment header
+		validSize = 0
+	}
+	for {
+		entry, err := reader.next()
+		if err != nil {
+			if _, ok := err.(*CorruptRecordError); !ok {
+				return 0, err
+			}
+			break
+		} else if entry == nil {
+			break
+		}
+		validSize = reader.pos
+	}
+
+	dropped := s.Size - validSize
+	if dropped <= 0 {
+		return 0, nil
+	}
+	if err := s.Truncate(validSize); err != nil {
+		return 0, errors.Wrap(err, "truncate failed")
+	}
+	return dropped, nil
+}
@@ -0,0 +1,138 @@
+package commitlog
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// SnapshotFile is a segment file in a snapshot.
+type SnapshotFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Snapshot is a point-in-time copy of a commit log.  The segments are captured
+// by Snapshot, and linked or copied to Dir by Complete.
+type Snapshot struct {
+	Dir   string
+	Files []SnapshotFile
+	// segments is the open segment files to copy up to the sizes in Files
+	segments []*os.File
+}
+
+// Snapshot captures the current content of the log to be written into dir by
+// Complete.  The segment files are only opened up to the current position, so
+// the caller should keep the log from being modified only until Snapshot
+// returns.  Since the segments are append-only and the open files stay
+// readable after the cleaner deletes them, Complete does not need the lock.
+// The index files are not included as they are rebuilt on demand.
+func (l *CommitLog) Snapshot(dir string) (*Snapshot, error) {
+	snap := &Snapshot{Dir: dir}
+	pos := l.Tell()
+	for _, segment := range l.segments {
+		file, err := os.Open(segment.filePath)
+		if err != nil {
+			snap.Abort()
+			return nil, errors.Wrap(err, "open file failed")
+		}
+		size := segment.Size
+		if segment == pos.segment {
+			size = pos.offset
+		}
+		snap.segments = append(snap.segments, file)
+		snap.Files = append(snap.Files, SnapshotFile{Name: filepath.Base(segment.filePath), Size: size})
+		if segment == pos.segment {
+			break
+		}
+	}
+	return snap, nil
+}
+
+// Complete writes the captured segments to Dir and syncs it to the disk.  The
+// sealed segments are hard-linked, or copied if linking is not possible, and
+// the active one is copied up to the captured position.
+func (s *Snapshot) Complete() error {
+	defer s.Abort()
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return errors.Wrap(err, "mkdir failed")
+	}
+	for i, file := range s.segments {
+		dst := filepath.Join(s.Dir, s.Files[i].Name)
+		sealed := i < len(s.segments)-1
+		if err := linkOrCopy(file, dst, s.Files[i].Size, sealed); err != nil {
+			return err
+		}
+	}
+	return syncDir(s.Dir)
+}
+
+// Abort releases the resources of the snapshot not completed.
+func (s *Snapshot) Abort() {
+	for _, file := range s.segments {
+		file.Close()
+	}
+	s.segments = nil
+}
+
+// linkOrCopy hard-links the file to dst if link is true and the file is still
+// in place, or copies its first size bytes otherwise.
+func linkOrCopy(file *os.File, dst string, size int64, link bool) error {
+	if link && os.Link(file.Name(), dst) == nil {
+		src, err1 := file.Stat()
+		linked, err2 := os.Stat(dst)
+		if err1 == nil && err2 == nil && os.SameFile(src, linked) {
+			return nil
+		}
+		// replaced after the cleaner deleted it
+		os.Remove(dst)
+	}
+	return copyFile(file, dst, size)
+}
+
+// copyFile copies the first size bytes of src to a new file dst.
+func copyFile(src *os.File, dst string, size int64) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return errors.Wrap(err, "open file failed")
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, io.NewSectionReader(src, 0, size)); err != nil {
+		return errors.Wrap(err, "copy failed")
+	}
+	if err := out.Sync(); err != nil {
+		return errors.Wrap(err, "sync failed")
+	}
+	return nil
+}
+
+// Restore copies the files of a snapshot in dir to the commit log directory
+// path, which must not have any segment yet.  The size of each file is checked
+// against the snapshot.
+func Restore(dir, path string, files []SnapshotFile) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return errors.Wrap(err, "mkdir failed")
+	}
+	for _, f := range files {
+		src := filepath.Join(dir, f.Name)
+		fi, err := os.Stat(src)
+		if err != nil {
+			return errors.Wrap(err, "file stat failed")
+		}
+		if fi.Size() != f.Size {
+			return errors.Errorf("%s has %d bytes, expected %d", src, fi.Size(), f.Size)
+		}
+		file, err := os.Open(src)
+		if err != nil {
+			return errors.Wrap(err, "open file failed")
+		}
+		err = copyFile(file, filepath.Join(path, f.Name), f.Size)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(path)
+}
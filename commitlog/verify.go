@@ -0,0 +1,262 @@
+package commitlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ProblemKind classifies the problems found by Verify.
+type ProblemKind string
+
+const (
+	// ProblemStray is a file which is neither a segment nor its index.
+	ProblemStray ProblemKind = "stray file"
+	// ProblemUnreadable is a segment whose header cannot be read.
+	ProblemUnreadable ProblemKind = "unreadable segment"
+	// ProblemCorrupt is a torn record or a checksum mismatch.  The records
+	// after it cannot be read.
+	ProblemCorrupt ProblemKind = "corrupt record"
+	// ProblemOutOfOrder is a record older than the one before it.
+	ProblemOutOfOrder ProblemKind = "out-of-order timestamp"
+	// ProblemBaseNano is a segment whose file name does not match the
+	// timestamp of its first record.
+	ProblemBaseNano ProblemKind = "base nanosec mismatch"
+	// ProblemOffset is a record whose offset does not increase from the one
+	// before it.
+	ProblemOffset ProblemKind = "non-increasing offset"
+)
+
+// RepairMode tells Verify what to do with the bad files.
+type RepairMode string
+
+const (
+	// RepairNone only reports the problems.
+	RepairNone RepairMode = ""
+	// RepairTruncate truncates the corrupt segments at the first bad record,
+	// and deletes the unreadable segments and the stray files.
+	RepairTruncate RepairMode = "truncate"
+	// RepairQuarantine moves the corrupt and unreadable segments and the
+	// stray files to the quarantine directory.
+	RepairQuarantine RepairMode = "quarantine"
+)
+
+// Problem is an inconsistency found in a commit log directory.
+type Problem struct {
+	Kind ProblemKind
+	Path string
+	// Offset is the file offset of the bad record, or -1 for the whole file
+	Offset int64
+	Detail string
+	// Repaired is true if the problem was fixed in the repair mode
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s: %s", p.Path, p.Kind)
+	if p.Offset >= 0 {
+		s += fmt.Sprintf(" at offset %d", p.Offset)
+	}
+	if p.Detail != "" {
+		s += " (" + p.Detail + ")"
+	}
+	if p.Repaired {
+		s += " [repaired]"
+	}
+	return s
+}
+
+// VerifyResult is the summary of a verified commit log directory.
+type VerifyResult struct {
+	Path     string
+	Segments int
+	Entries  int64
+	Problems []Problem
+}
+
+// Verify checks every segment file in the commit log directory with the record
+// decoder.  The directory must not be written by another process while it is
+// verified.  With a repair mode, the bad files are fixed as described in
+// RepairMode; quarantineDir is required for RepairQuarantine.
+func Verify(path string, mode RepairMode, quarantineDir string) (*VerifyResult, error) {
+	if mode == RepairQuarantine && quarantineDir == "" {
+		return nil, errors.New("quarantine directory is not specified")
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read dir failed")
+	}
+	result := &VerifyResult{Path: path}
+	logs := map[string]bool{}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), LogFileSuffix) {
+			logs[strings.TrimSuffix(file.Name(), LogFileSuffix)] = true
+		}
+	}
+	lastNano := int64(-1 << 63)
+	lastOffset := int64(-1)
+	for _, file := range files {
+		filePath := filepath.Join(path, file.Name())
+		stem := strings.TrimSuffix(strings.TrimSuffix(file.Name(), LogFileSuffix), IndexFileSuffix)
+		baseNano, err := strconv.ParseInt(stem, 10, 64)
+		if file.IsDir() || err != nil || stem == file.Name() ||
+			(strings.HasSuffix(file.Name(), IndexFileSuffix) && !logs[stem]) {
+			problem := Problem{Kind: ProblemStray, Path: filePath, Offset: -1}
+			if mode != RepairNone {
+				problem.Repaired, err = removeBadFile(filePath, mode, quarantineDir)
+				if err != nil {
+					return result, err
+				}
+			}
+			result.Problems = append(result.Problems, problem)
+			continue
+		}
+		if strings.HasSuffix(file.Name(), IndexFileSuffix) {
+			// the index files are rebuilt when they are stale
+			continue
+		}
+		result.Segments++
+		problems, err := verifySegment(filePath, baseNano, &lastNano, &lastOffset, result)
+		if err != nil {
+			return result, err
+		}
+		for _, problem := range problems {
+			if mode != RepairNone && (problem.Kind == ProblemCorrupt || problem.Kind == ProblemUnreadable) {
+				if problem.Repaired, err = repairSegment(path, baseNano, problem, mode, quarantineDir); err != nil {
+					return result, err
+				}
+			}
+			result.Problems = append(result.Problems, problem)
+		}
+	}
+	return result, nil
+}
+
+// verifySegment reads through the segment file and returns the problems in it.
+// lastNano and lastOffset are of the last record read before the segment.
+func verifySegment(filePath string, baseNano int64, lastNano, lastOffset *int64, result *VerifyResult) ([]Problem, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file failed")
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "file stat failed")
+	}
+	reader, err := newRecordReader(file, filePath, fi.Size())
+	if err != nil {
+		return []Problem{{Kind: ProblemUnreadable, Path: filePath, Offset: -1, Detail: err.Error()}}, nil
+	}
+	problems := []Problem{}
+	first := true
+	for {
+		pos := reader.pos
+		entry, err := reader.next()
+		if err != nil {
+			if corrupt, ok := err.(*CorruptRecordError); ok {
+				problems = append(problems, Problem{
+					Kind:   ProblemCorrupt,
+					Path:   filePath,
+					Offset: corrupt.Offset,
+					Detail: fmt.Sprintf("%s, %d bytes unreadable", corrupt.Reason, fi.Size()-corrupt.Offset),
+				})
+				return problems, nil
+			}
+			return nil, err
+		} else if entry == nil {
+			return problems, nil
+		}
+		result.Entries++
+		nanosec := entry.Timestamp.UnixNano()
+		// a late record is older than the ones before it by design, and the
+		// segment starting with one is named after the latest timestamp.  A
+		// segment is named just after the previous one if they start at the
+		// same timestamp.
+		if first && nanosec != baseNano && !((entry.late || nanosec == *lastNano) && nanosec < baseNano) {
+			problems = append(problems, Problem{
+				Kind:   ProblemBaseNano,
+				Path:   filePath,
+				Offset: pos,
+				Detail: fmt.Sprintf("first record at %d", nanosec),
+			})
+		}
+		if nanosec < *lastNano && !entry.late {
+			problems = append(problems, Problem{
+				Kind:   ProblemOutOfOrder,
+				Path:   filePath,
+				Offset: pos,
+				Detail: fmt.Sprintf("%d after %d", nanosec, *lastNano),
+			})
+		}
+		if reader.version >= formatV2 {
+			if entry.Offset <= *lastOffset {
+				problems = append(problems, Problem{
+					Kind:   ProblemOffset,
+					Path:   filePath,
+					Offset: pos,
+					Detail: fmt.Sprintf("%d after %d", entry.Offset, *lastOffset),
+				})
+			}
+			*lastOffset = entry.Offset
+		}
+		first = false
+		if nanosec > *lastNano {
+			*lastNano = nanosec
+		}
+	}
+}
+
+// repairSegment truncates the segment at the corrupt record or removes it.
+func repairSegment(path string, baseNano int64, problem Problem, mode RepairMode, quarantineDir string) (bool, error) {
+	if mode == RepairTruncate && problem.Kind == ProblemCorrupt && problem.Offset > int64(segmentHeaderLen) {
+		segment, err := NewSegment(path, baseNano, 0)
+		if err != nil {
+			return false, err
+		}
+		if err := segment.Truncate(problem.Offset); err != nil {
+			return false, errors.Wrap(err, "truncate failed")
+		}
+		return true, nil
+	}
+	indexPath := filepath.Join(path, fmt.Sprintf(indexNameFormat, baseNano))
+	if _, err := removeBadFile(indexPath, mode, quarantineDir); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return false, err
+	}
+	return removeBadFile(problem.Path, mode, quarantineDir)
+}
+
+// RepairStray deletes the stray file found outside of the commit log
+// directories, or moves it to quarantineDir, as Verify does for the ones in
+// them.  Only reports it in RepairNone.
+func RepairStray(filePath string, mode RepairMode, quarantineDir string) (Problem, error) {
+	problem := Problem{Kind: ProblemStray, Path: filePath, Offset: -1}
+	repaired, err := removeBadFile(filePath, mode, quarantineDir)
+	problem.Repaired = repaired
+	return problem, err
+}
+
+// removeBadFile deletes the file or moves it to the quarantine directory.
+func removeBadFile(filePath string, mode RepairMode, quarantineDir string) (bool, error) {
+	switch mode {
+	case RepairTruncate:
+		if err := os.RemoveAll(filePath); err != nil {
+			return false, errors.Wrap(err, "remove failed")
+		}
+	case RepairQuarantine:
+		if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+			return false, errors.Wrap(err, "mkdir failed")
+		}
+		if err := os.Rename(filePath, filepath.Join(quarantineDir, filepath.Base(filePath))); err != nil {
+			return false, errors.Wrap(err, "rename failed")
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
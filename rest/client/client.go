@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/alpacahq/slait/cache"
 	"github.com/alpacahq/slait/rest"
 )
 
@@ -27,19 +29,51 @@ func (sc *SlaitClient) PostTopic(tr rest.TopicsRequest) (err error) {
 
 // used for delivering the data
 func (sc *SlaitClient) PutPartition(topic, partition string, data []byte) error {
-	_, err := sc.request(
+	_, err := sc.PutPartitionResult(topic, partition, data)
+	return err
+}
+
+// deliver the data and get how many entries are accepted and dropped.  A
+// partial append is not an error, and the rejected entries are in the result.
+// The result is returned along with the error if the server reports it.
+func (sc *SlaitClient) PutPartitionResult(topic, partition string, data []byte) (*rest.AppendResponse, error) {
+	body, err := sc.request(
 		"PUT",
-		fmt.Sprintf("%v/topics/%v/%v", sc.Endpoint, topic, partition),
+		fmt.Sprintf("%v/topics/%v/%v", sc.Endpoint, topic, url.PathEscape(partition)),
 		data,
 	)
-	return err
+	resp := rest.AppendResponse{AppendResult: &cache.AppendResult{}}
+	if e := json.Unmarshal(body, &resp); e != nil {
+		if err == nil {
+			err = e
+		}
+		return nil, err
+	}
+	return &resp, err
+}
+
+// deliver the data to several partitions all-or-nothing
+func (sc *SlaitClient) PostBatch(writes []cache.Write) (*rest.BatchResponse, error) {
+	data, err := json.Marshal(rest.BatchRequest{Writes: writes})
+	if err != nil {
+		return nil, err
+	}
+	body, err := sc.request("POST", sc.Endpoint+"/batch", data)
+	resp := rest.BatchResponse{}
+	if e := json.Unmarshal(body, &resp); e != nil {
+		if err == nil {
+			err = e
+		}
+		return nil, err
+	}
+	return &resp, err
 }
 
 // delete a partition
 func (sc *SlaitClient) DeletePartition(topic, partition string) error {
 	_, err := sc.request(
 		"DELETE",
-		fmt.Sprintf("%v/topics/%v/%v", sc.Endpoint, topic, partition),
+		fmt.Sprintf("%v/topics/%v/%v", sc.Endpoint, topic, url.PathEscape(partition)),
 		nil,
 	)
 	return err
@@ -58,7 +92,55 @@ func (sc *SlaitClient) GetPartition(topic, partition string, from, to *time.Time
 	}
 	data, err := sc.request(
 		"GET",
-		fmt.Sprintf("%v/topics/%v/%v?%v", sc.Endpoint, topic, partition, q),
+		fmt.Sprintf("%v/topics/%v/%v?%v", sc.Endpoint, topic, url.PathEscape(partition), q),
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := rest.PartitionRequestResponse{}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, err
+}
+
+// get the entries at or after the offset, e.g. the one next to the last
+// entry received
+func (sc *SlaitClient) GetPartitionFromOffset(topic, partition string, offset int64, last int) (*rest.PartitionRequestResponse, error) {
+	q := fmt.Sprintf("offset=%v", offset)
+	if last > 0 {
+		q = fmt.Sprintf("%v&%v=%v", q, "last", last)
+	}
+	data, err := sc.request(
+		"GET",
+		fmt.Sprintf("%v/topics/%v/%v?%v", sc.Endpoint, topic, url.PathEscape(partition), q),
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := rest.PartitionRequestResponse{}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, err
+}
+
+// get a page of up to limit entries next to the cursor, which is Next or Prev
+// of the previous page.  The first page is the oldest entries in the range.
+func (sc *SlaitClient) GetPartitionPage(topic, partition string, from, to *time.Time, cursor string, limit int) (*rest.PartitionRequestResponse, error) {
+	q := fmt.Sprintf("limit=%v", limit)
+	if cursor != "" {
+		q = fmt.Sprintf("%v&%v=%v", q, "cursor", cursor)
+	}
+	if from != nil && !from.IsZero() {
+		q = fmt.Sprintf("%v&%v=%v", q, "from", url.QueryEscape(from.Format(time.RFC3339)))
+	}
+	if to != nil && !to.IsZero() {
+		q = fmt.Sprintf("%v&%v=%v", q, "to", url.QueryEscape(to.Format(time.RFC3339)))
+	}
+	data, err := sc.request(
+		"GET",
+		fmt.Sprintf("%v/topics/%v/%v?%v", sc.Endpoint, topic, url.PathEscape(partition), q),
 		nil)
 	if err != nil {
 		return nil, err
@@ -70,6 +152,56 @@ func (sc *SlaitClient) GetPartition(topic, partition string, from, to *time.Time
 	return &resp, err
 }
 
+// get the last entries of every partition in the topic
+func (sc *SlaitClient) GetTopic(topic string, from, to *time.Time, last int) (*rest.TopicResponse, error) {
+	q := fmt.Sprintf("last=%v", last)
+	if from != nil && !from.IsZero() {
+		q = fmt.Sprintf("%v&%v=%v", q, "from", url.QueryEscape(from.Format(time.RFC3339)))
+	}
+	if to != nil && !to.IsZero() {
+		q = fmt.Sprintf("%v&%v=%v", q, "to", url.QueryEscape(to.Format(time.RFC3339)))
+	}
+	data, err := sc.request("GET", fmt.Sprintf("%v/topics/%v?%v", sc.Endpoint, topic, q), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := rest.TopicResponse{}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, err
+}
+
+// get the latest entry of every partition in the topic
+func (sc *SlaitClient) GetLatest(topic string) (*rest.LatestResponse, error) {
+	data, err := sc.request("GET", fmt.Sprintf("%v/topics/%v?latest", sc.Endpoint, topic), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := rest.LatestResponse{}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, err
+}
+
+// take a snapshot of the data directory to the path on the server
+func (sc *SlaitClient) Snapshot(path string) (*cache.Manifest, error) {
+	data, err := json.Marshal(rest.SnapshotRequest{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	data, err = sc.request("POST", sc.Endpoint+"/snapshots", data)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &cache.Manifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
 func (sc *SlaitClient) request(method, url string, data []byte) ([]byte, error) {
 	req, err := http.NewRequest(method, url, bytes.NewReader(data))
 	if err != nil {
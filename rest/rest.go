@@ -21,7 +21,11 @@ func (rest REST) Start() error {
 	app.HandleMany("GET HEAD", "/heartbeat", HeartbeatHandler)
 	app.HandleMany("GET POST DELETE", "/topics", TopicsHandler)
 	app.HandleMany("GET PUT DELETE", "/topics/{topic:string}", TopicHandler)
-	app.HandleMany("GET PUT DELETE", "/topics/{topic:string}/{partition:string}", PartitionHandler)
+	// the partition key may contain slashes
+	app.HandleMany("GET PUT DELETE", "/topics/{topic:string}/{partition:path}", PartitionHandler)
+	app.Post("/batch", BatchHandler)
+	app.Post("/snapshots", SnapshotsHandler)
+	app.Get("/usage", UsageHandler)
 	app.Any("/ws", iris.FromStd(socket.GetHandler().Serve))
 	// profiling
 	app.Any("/debug/pprof/{action:path}", Profiler())
@@ -38,6 +42,21 @@ type TopicsRequest struct {
 	Partitions []string
 }
 
+type SnapshotRequest struct {
+	Path string
+}
+
+type BatchRequest struct {
+	Writes []cache.Write `json:"writes"`
+}
+
+// BatchResponse is the results of the writes in a batch in the same order,
+// with the message of the error if any.
+type BatchResponse struct {
+	Results []*cache.AppendResult `json:"results"`
+	Message string                `json:"message,omitempty"`
+}
+
 func Profiler() iris.Handler {
 	indexHandler := handlerconv.FromStd(pprof.Index)
 	cmdlineHandler := handlerconv.FromStd(pprof.Cmdline)
@@ -116,13 +135,30 @@ func TopicsHandler(ctx iris.Context) {
 	}
 }
 
-// GET: list all the partition keys under this topic
+// GET: list all the partition keys under this topic, the metadata of the topic
+// with ?metadata, the entries of every partition with ?last, ?from or ?to, or
+// the latest entry of every partition with ?latest
 // PUT: update the metadata of a topic
 // DELETE: delete a topic
 func TopicHandler(ctx iris.Context) {
 	topic := ctx.Params().Get("topic")
 	switch ctx.Method() {
 	case "GET":
+		if _, ok := ctx.Request().URL.Query()["metadata"]; ok {
+			meta, err := cache.GetMetadata(topic)
+			if err != nil {
+				respondWithError(ctx, err.Error(), iris.StatusNotFound)
+				return
+			}
+			respondWithJSON(ctx, meta, iris.StatusOK)
+			return
+		}
+		params := ctx.Request().URL.Query()
+		_, latest := params["latest"]
+		if latest || params.Get("last") != "" || params.Get("from") != "" || params.Get("to") != "" {
+			topicData(ctx, topic, latest)
+			return
+		}
 		pMap := cache.Catalog()[topic]
 		partitions := make([]string, len(pMap))
 		i := 0
@@ -132,7 +168,20 @@ func TopicHandler(ctx iris.Context) {
 		}
 		respondWithJSON(ctx, partitions, iris.StatusOK)
 	case "PUT":
-		// TODO: implement metadata update
+		if _, ok := cache.Catalog()[topic]; !ok {
+			respondWithError(ctx, "Topic does not exist", iris.StatusNotFound)
+			return
+		}
+		meta := &cache.Metadata{}
+		if err := ctx.ReadJSON(meta); err != nil {
+			respondWithError(ctx, err.Error(), iris.StatusBadRequest)
+			return
+		}
+		if err := cache.SetMetadata(topic, meta); err != nil {
+			respondWithError(ctx, err.Error(), iris.StatusBadRequest)
+			return
+		}
+		respondWithJSON(ctx, meta, iris.StatusOK)
 	case "DELETE":
 		cache.Remove(topic)
 		respondWithJSON(ctx, nil, iris.StatusOK)
@@ -141,9 +190,95 @@ func TopicHandler(ctx iris.Context) {
 
 type PartitionRequestResponse struct {
 	Data cache.Entries
+	// Next and Prev are the cursors to the adjacent pages with ?limit
+	Next string `json:",omitempty"`
+	Prev string `json:",omitempty"`
+}
+
+// TopicResponse is the entries of every partition in a topic.
+type TopicResponse struct {
+	Data map[string]cache.Entries
+}
+
+// LatestResponse is the latest entry of every partition in a topic.
+type LatestResponse struct {
+	Data map[string]*cache.Entry
 }
 
-// GET: query entries from a partition
+// topicData responds with the entries of every partition in the topic
+// qualified by from, to and last, or only the latest ones.
+func topicData(ctx iris.Context, topic string, latest bool) {
+	params := ctx.Request().URL.Query()
+	from, err := parseTimeString(params.Get("from"), "from")
+	if err != nil {
+		respondWithError(ctx, err.Error(), iris.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeString(params.Get("to"), "to")
+	if err != nil {
+		respondWithError(ctx, err.Error(), iris.StatusBadRequest)
+		return
+	}
+	if latest {
+		data := cache.Latest(topic, from, to)
+		if data == nil {
+			respondWithError(ctx, cache.ErrTopicNotFound.Error(), iris.StatusNotFound)
+			return
+		}
+		respondWithJSON(ctx, LatestResponse{Data: data}, iris.StatusOK)
+		return
+	}
+	last := 0
+	if str := params.Get("last"); str != "" {
+		if last, err = strconv.Atoi(str); err != nil || last < 0 {
+			respondWithError(ctx, "Invalid last: "+str, iris.StatusBadRequest)
+			return
+		}
+	}
+	data := cache.GetAll(topic, from, to, last)
+	if data == nil {
+		respondWithError(ctx, cache.ErrTopicNotFound.Error(), iris.StatusNotFound)
+		return
+	}
+	respondWithJSON(ctx, TopicResponse{Data: data}, iris.StatusOK)
+}
+
+// AppendResponse is the result of PUT to a partition, with the message of the
+// error if any.
+type AppendResponse struct {
+	*cache.AppendResult
+	Message string `json:"message,omitempty"`
+}
+
+// appendStatus returns the HTTP status code for the result of an append.  The
+// result is nil if nothing is appended.  A partial append is still 200, with
+// the rejected entries in the result.
+func appendStatus(result *cache.AppendResult, err error) int {
+	switch err.(type) {
+	case nil:
+		return iris.StatusOK
+	case *cache.OutOfOrderError:
+		if result == nil || result.Accepted+result.Duplicates == 0 {
+			return iris.StatusConflict
+		}
+		return iris.StatusOK
+	case *cache.StorageError:
+		return iris.StatusInsufficientStorage
+	case *cache.NameError:
+		return iris.StatusBadRequest
+	}
+	switch err {
+	case cache.ErrTopicNotFound:
+		return iris.StatusNotFound
+	case cache.ErrDuplicatePartition:
+		return iris.StatusBadRequest
+	case cache.ErrNothingNew:
+		return iris.StatusConflict
+	}
+	return iris.StatusInternalServerError
+}
+
+// GET: query entries from a partition, a page at a time with ?limit and ?cursor
 // PUT: append new entries to a partition. a new partition is created if non-existent.
 // DELETE: delete a partition along with its entries
 func PartitionHandler(ctx iris.Context) {
@@ -162,10 +297,35 @@ func PartitionHandler(ctx iris.Context) {
 			respondWithError(ctx, err.Error(), iris.StatusBadRequest)
 			return
 		}
+		offset := int64(0)
+		if str := params.Get("offset"); str != "" {
+			if offset, err = strconv.ParseInt(str, 10, 64); err != nil || offset < 0 {
+				respondWithError(ctx, "Invalid offset: "+str, iris.StatusBadRequest)
+				return
+			}
+		}
 		last, _ := strconv.ParseInt(params.Get("last"), 10, 32)
+		if str := params.Get("limit"); str != "" || params.Get("cursor") != "" {
+			limit, err := strconv.Atoi(str)
+			if err != nil || limit <= 0 {
+				respondWithError(ctx, "Invalid limit: "+str, iris.StatusBadRequest)
+				return
+			}
+			page, err := cache.GetPage(topic, partition, offset, from, to, params.Get("cursor"), limit, last > 0)
+			if err != nil {
+				respondWithError(ctx, err.Error(), iris.StatusBadRequest)
+				return
+			}
+			respondWithJSON(
+				ctx,
+				PartitionRequestResponse{Data: page.Entries, Next: page.Next, Prev: page.Prev},
+				iris.StatusOK,
+			)
+			return
+		}
 		respondWithJSON(
 			ctx,
-			PartitionRequestResponse{Data: cache.Get(topic, partition, from, to, int(last))},
+			PartitionRequestResponse{Data: cache.GetOffset(topic, partition, offset, from, to, int(last))},
 			iris.StatusOK,
 		)
 	case "PUT":
@@ -183,16 +343,87 @@ func PartitionHandler(ctx iris.Context) {
 			entries[i] = &cache.Entry{
 				Timestamp: pReq.Data[i].Timestamp,
 				Data:      []byte(pReq.Data[i].Data),
+				ID:        pReq.Data[i].ID,
 			}
 		}
-		cache.Append(topic, partition, entries)
-		respondWithJSON(ctx, nil, iris.StatusOK)
+		result, err := cache.AppendResults(topic, partition, entries)
+		code := appendStatus(result, err)
+		if result == nil {
+			respondWithError(ctx, err.Error(), code)
+			return
+		}
+		resp := AppendResponse{AppendResult: result}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		respondWithJSON(ctx, resp, code)
 	case "DELETE":
 		cache.Update(topic, partition, cache.RemovePartition)
 		respondWithJSON(ctx, nil, iris.StatusOK)
 	}
 }
 
+// POST: append entries to several partitions all-or-nothing
+func BatchHandler(ctx iris.Context) {
+	bReq := BatchRequest{}
+	if err := ctx.ReadJSON(&bReq); err != nil {
+		respondWithError(ctx, err.Error(), iris.StatusBadRequest)
+		return
+	}
+	if len(bReq.Writes) == 0 {
+		respondWithError(ctx, "Writes are required", iris.StatusBadRequest)
+		return
+	}
+	for _, w := range bReq.Writes {
+		if len(w.Entries) == 0 {
+			respondWithError(ctx, "Data is required", iris.StatusBadRequest)
+			return
+		}
+	}
+	results, err := cache.AppendMulti(bReq.Writes)
+	// nothing is appended if there is an error
+	code := appendStatus(nil, err)
+	if results == nil {
+		respondWithError(ctx, err.Error(), code)
+		return
+	}
+	resp := BatchResponse{Results: results}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	respondWithJSON(ctx, resp, code)
+}
+
+// GET: memory usage of the cache by topic and partition
+func UsageHandler(ctx iris.Context) {
+	respondWithJSON(ctx, cache.MemoryUsage(), iris.StatusOK)
+}
+
+// POST: take a snapshot of the data directory to the path under snapshot_dir
+func SnapshotsHandler(ctx iris.Context) {
+	sReq := SnapshotRequest{}
+	if err := ctx.ReadJSON(&sReq); err != nil {
+		respondWithError(ctx, err.Error(), iris.StatusBadRequest)
+		return
+	}
+	if sReq.Path == "" {
+		respondWithError(ctx, "Path is required", iris.StatusBadRequest)
+		return
+	}
+	manifest, err := cache.Snapshot(sReq.Path)
+	if err != nil {
+		code := iris.StatusInternalServerError
+		if err == cache.ErrSnapshotsDisabled {
+			code = iris.StatusForbidden
+		} else if _, ok := err.(*cache.NameError); ok {
+			code = iris.StatusBadRequest
+		}
+		respondWithError(ctx, err.Error(), code)
+		return
+	}
+	respondWithJSON(ctx, manifest, iris.StatusOK)
+}
+
 func respondWithError(ctx iris.Context, message string, code int) {
 	respondWithJSON(ctx, map[string]string{"message": message}, code)
 }
@@ -3,12 +3,14 @@ package rest
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/alpacahq/slait/cache"
 	"github.com/alpacahq/slait/socket"
+	"github.com/alpacahq/slait/utils"
 	"github.com/kataras/iris"
 
 	. "gopkg.in/check.v1"
@@ -42,7 +44,8 @@ func (s *RESTTestSuite) TestCache(c *C) {
 	app := iris.New()
 	app.HandleMany("GET POST DELETE", "/topics", TopicsHandler)
 	app.HandleMany("GET PUT DELETE", "/topics/{topic:string}", TopicHandler)
-	app.HandleMany("GET PUT DELETE", "/topics/{topic:string}/{partition:string}", PartitionHandler)
+	app.HandleMany("GET PUT DELETE", "/topics/{topic:string}/{partition:path}", PartitionHandler)
+	app.Get("/usage", UsageHandler)
 	app.Any("/ws", iris.FromStd(socket.GetHandler().Serve))
 	app.Build()
 
@@ -79,6 +82,32 @@ func (s *RESTTestSuite) TestCache(c *C) {
 	rr = httptest.NewRecorder()
 	app.ServeHTTP(rr, req)
 	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+	result := cache.AppendResult{}
+	c.Assert(json.Unmarshal(rr.Body.Bytes(), &result), IsNil)
+	c.Assert(result.Accepted, Equals, 5)
+	c.Assert(result.Dropped, Equals, 0)
+	c.Assert(result.LastOffset, Equals, int64(4))
+	c.Assert(result.LastTimestamp.Equal(pr.Data[4].Timestamp), Equals, true)
+
+	// retry with the entry IDs
+	for i := range pr.Data {
+		pr.Data[i].ID = fmt.Sprintf("msg-%d", i)
+	}
+	data, _ = json.Marshal(pr)
+	for _, accepted := range []int{5, 0} {
+		req, _ = http.NewRequest("PUT", "/topics/bars/AMD_composite", bytes.NewBuffer(data))
+		rr = httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+		result = cache.AppendResult{}
+		c.Assert(json.Unmarshal(rr.Body.Bytes(), &result), IsNil)
+		c.Assert(result.Accepted, Equals, accepted)
+		c.Assert(result.Duplicates, Equals, 5-accepted)
+	}
+	req, _ = http.NewRequest("DELETE", "/topics/bars/AMD_composite", nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
 
 	pr = PartitionRequestResponse{
 		Data: cache.GenData(),
@@ -98,6 +127,37 @@ func (s *RESTTestSuite) TestCache(c *C) {
 	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
 	c.Assert(len(tResp), Equals, 1)
 
+	// update the metadata of a topic
+	meta := cache.Metadata{
+		Description: "1 minute bars",
+		Retention:   &cache.Retention{Duration: "24h"},
+		Labels:      map[string]string{"source": "composite"},
+	}
+	data, _ = json.Marshal(meta)
+	req, _ = http.NewRequest("PUT", "/topics/bars", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+
+	// get the metadata of a topic
+	req, _ = http.NewRequest("GET", "/topics/bars?metadata", nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	mResp := cache.Metadata{}
+	json.Unmarshal(rr.Body.Bytes(), &mResp)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+	c.Assert(mResp, DeepEquals, meta)
+
+	// get the memory usage
+	req, _ = http.NewRequest("GET", "/usage", nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	usage := cache.Usage{}
+	json.Unmarshal(rr.Body.Bytes(), &usage)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+	c.Assert(usage.Topics["bars"].Partitions["NVDA_composite"].Entries, Equals, 5)
+	c.Assert(usage.Bytes > 0, Equals, true)
+
 	// get a partition
 	req, _ = http.NewRequest("GET", "/topics/bars/NVDA_composite", nil)
 	rr = httptest.NewRecorder()
@@ -107,6 +167,61 @@ func (s *RESTTestSuite) TestCache(c *C) {
 	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
 	c.Assert(len(pResp.Data), Equals, 5)
 
+	// get a partition from an offset
+	req, _ = http.NewRequest("GET", "/topics/bars/NVDA_composite?offset=3", nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	pResp = PartitionRequestResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &pResp)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+	c.Assert(len(pResp.Data), Equals, 2)
+	c.Assert(pResp.Data[0].Offset, Equals, int64(3))
+
+	// get a partition page by page
+	offsets := []int64{}
+	for url := "/topics/bars/NVDA_composite?limit=2"; url != ""; {
+		req, _ = http.NewRequest("GET", url, nil)
+		rr = httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+		pResp = PartitionRequestResponse{}
+		json.Unmarshal(rr.Body.Bytes(), &pResp)
+		c.Assert(len(pResp.Data) <= 2, Equals, true)
+		for _, entry := range pResp.Data {
+			offsets = append(offsets, entry.Offset)
+		}
+		url = ""
+		if pResp.Next != "" {
+			url = "/topics/bars/NVDA_composite?limit=2&cursor=" + pResp.Next
+		}
+	}
+	c.Assert(offsets, DeepEquals, []int64{0, 1, 2, 3, 4})
+	req, _ = http.NewRequest("GET", "/topics/bars/NVDA_composite?limit=2&cursor="+pResp.Prev, nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	pResp = PartitionRequestResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &pResp)
+	c.Assert(pResp.Data[0].Offset, Equals, int64(2))
+	c.Assert(pResp.Data[1].Offset, Equals, int64(3))
+
+	// get the last entries of every partition in a topic
+	req, _ = http.NewRequest("GET", "/topics/bars?last=10", nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	dResp := TopicResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &dResp)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+	c.Assert(len(dResp.Data["NVDA_composite"]), Equals, 5)
+
+	// get the latest entry of every partition in a topic
+	req, _ = http.NewRequest("GET", "/topics/bars?latest", nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	lResp := LatestResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &lResp)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+	c.Assert(lResp.Data["NVDA_composite"].Offset, Equals, int64(4))
+
 	// delete a partition
 	req, _ = http.NewRequest("DELETE", "/topics/bars/NVDA_composite", nil)
 	rr = httptest.NewRecorder()
@@ -131,7 +246,8 @@ func (s *RESTTestSuite) TestErrors(c *C) {
 	app := iris.New()
 	app.HandleMany("GET POST DELETE", "/topics", TopicsHandler)
 	app.HandleMany("GET PUT DELETE", "/topics/{topic:string}", TopicHandler)
-	app.HandleMany("GET PUT DELETE", "/topics/{topic:string}/{partition:string}", PartitionHandler)
+	app.HandleMany("GET PUT DELETE", "/topics/{topic:string}/{partition:path}", PartitionHandler)
+	app.Post("/snapshots", SnapshotsHandler)
 	app.Any("/ws", iris.FromStd(socket.GetHandler().Serve))
 	app.Build()
 
@@ -159,6 +275,13 @@ func (s *RESTTestSuite) TestErrors(c *C) {
 	app.ServeHTTP(rr, req)
 	c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
 
+	// POST topic [invalid name]
+	data, _ = json.Marshal(TopicsRequest{Topic: "../bars"})
+	req, _ = http.NewRequest("POST", "/topics", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
+
 	// GET partition [bad from timestamp]
 	req, _ = http.NewRequest("GET", "/topics/bars/NVDA_composite?from=badtimestamp", nil)
 	rr = httptest.NewRecorder()
@@ -171,6 +294,32 @@ func (s *RESTTestSuite) TestErrors(c *C) {
 	app.ServeHTTP(rr, req)
 	c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
 
+	// GET topic [bad last]
+	req, _ = http.NewRequest("GET", "/topics/bars?last=-1", nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
+
+	// GET topic [topic does not exist]
+	req, _ = http.NewRequest("GET", "/topics/trades?latest", nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusNotFound)
+
+	// GET partition [bad limit and cursor]
+	for _, q := range []string{"limit=0", "limit=2&cursor=garbage", "cursor=garbage"} {
+		req, _ = http.NewRequest("GET", "/topics/bars/NVDA_composite?"+q, nil)
+		rr = httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
+	}
+
+	// GET partition [bad offset]
+	req, _ = http.NewRequest("GET", "/topics/bars/NVDA_composite?offset=-1", nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
+
 	// PUT to partition [nil data]
 	req, _ = http.NewRequest("PUT", "/topics/bars/NVDA_composite", nil)
 	rr = httptest.NewRecorder()
@@ -184,4 +333,150 @@ func (s *RESTTestSuite) TestErrors(c *C) {
 	rr = httptest.NewRecorder()
 	app.ServeHTTP(rr, req)
 	c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
+
+	// PUT topic metadata [topic does not exist]
+	data, _ = json.Marshal(cache.Metadata{Description: "quotes"})
+	req, _ = http.NewRequest("PUT", "/topics/quotes", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusNotFound)
+
+	// PUT topic metadata [bad retention]
+	data, _ = json.Marshal(cache.Metadata{Retention: &cache.Retention{MaxBytes: "lots"}})
+	req, _ = http.NewRequest("PUT", "/topics/bars", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
+
+	// PUT to partition [topic does not exist]
+	entries := cache.GenData()
+	data, _ = json.Marshal(PartitionRequestResponse{Data: entries})
+	req, _ = http.NewRequest("PUT", "/topics/trades/NVDA", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusNotFound)
+
+	// PUT to partition [invalid topic name]
+	req, _ = http.NewRequest("PUT", "/topics/.metadata/NVDA", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
+
+	// PUT to partition [escaped key]
+	req, _ = http.NewRequest("PUT", "/topics/bars/ES%2FH24", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+	c.Assert(len(cache.Get("bars", "ES/H24", nil, nil, 0)), Equals, len(entries))
+
+	// PUT to partition [out of order rejected]
+	defer func(config []utils.TopicPlan) {
+		utils.GlobalConfig.TopicConfig = config
+	}(utils.GlobalConfig.TopicConfig)
+	utils.GlobalConfig.TopicConfig = []utils.TopicPlan{
+		{TopicMatch: "^trades$", OutOfOrder: cache.OutOfOrderReject},
+	}
+	cache.Add("trades")
+	data, _ = json.Marshal(PartitionRequestResponse{Data: entries[1:3]})
+	req, _ = http.NewRequest("PUT", "/topics/trades/NVDA", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+	data, _ = json.Marshal(PartitionRequestResponse{Data: cache.Entries{entries[0], entries[3]}})
+	req, _ = http.NewRequest("PUT", "/topics/trades/NVDA", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusOK)
+	resp := map[string]interface{}{}
+	c.Assert(json.Unmarshal(rr.Body.Bytes(), &resp), IsNil)
+	c.Assert(resp["accepted"], Equals, 1.0)
+	c.Assert(resp["dropped"], Equals, 1.0)
+	c.Assert(resp["dropped_entries"], HasLen, 1)
+	c.Assert(resp["message"], NotNil)
+	c.Assert(resp["last_offset"], Equals, 2.0)
+
+	// PUT to partition [fully stale]
+	data, _ = json.Marshal(PartitionRequestResponse{Data: entries[:1]})
+	req, _ = http.NewRequest("PUT", "/topics/trades/NVDA", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusConflict)
+	for i, code := range []int{iris.StatusOK, iris.StatusConflict} {
+		data, _ = json.Marshal(PartitionRequestResponse{Data: entries[1-i : 2-i]})
+		req, _ = http.NewRequest("PUT", "/topics/bars/TSLA", bytes.NewBuffer(data))
+		rr = httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		c.Assert(rr.Result().StatusCode, Equals, code)
+	}
+
+	// POST snapshot [empty path]
+	data, _ = json.Marshal(SnapshotRequest{})
+	req, _ = http.NewRequest("POST", "/snapshots", bytes.NewBuffer(data))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	c.Assert(rr.Result().StatusCode, Equals, iris.StatusBadRequest)
+
+	// POST snapshot [disabled, outside of snapshot_dir]
+	defer func(dir string) {
+		utils.GlobalConfig.SnapshotDir = dir
+	}(utils.GlobalConfig.SnapshotDir)
+	for _, t := range []struct {
+		root, path string
+		code       int
+	}{
+		{"", "snap", iris.StatusForbidden},
+		{c.MkDir(), "/etc/snap", iris.StatusBadRequest},
+		{c.MkDir(), "snap", iris.StatusOK},
+	} {
+		utils.GlobalConfig.SnapshotDir = t.root
+		data, _ = json.Marshal(SnapshotRequest{Path: t.path})
+		req, _ = http.NewRequest("POST", "/snapshots", bytes.NewBuffer(data))
+		rr = httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		c.Assert(rr.Result().StatusCode, Equals, t.code)
+	}
+}
+
+func (s *RESTTestSuite) TestBatch(c *C) {
+	cache.Build(c.MkDir())
+	app := iris.New()
+	app.Post("/batch", BatchHandler)
+	app.Build()
+	cache.Add("quotes")
+	cache.Add("trades")
+	data := cache.GenData()
+
+	for _, t := range []struct {
+		writes []cache.Write
+		code   int
+	}{
+		{nil, iris.StatusBadRequest},
+		{[]cache.Write{{Topic: "quotes", Partition: "AMD"}}, iris.StatusBadRequest},
+		{[]cache.Write{{Topic: "bars", Partition: "AMD", Entries: data[1:]}}, iris.StatusNotFound},
+		{[]cache.Write{
+			{Topic: "quotes", Partition: "AMD", Entries: data[1:]},
+			{Topic: "quotes", Partition: "AMD", Entries: data[1:]},
+		}, iris.StatusBadRequest},
+		{[]cache.Write{
+			{Topic: "quotes", Partition: "AMD", Entries: data[1:]},
+			{Topic: "trades", Partition: "AMD", Entries: data[1:]},
+		}, iris.StatusOK},
+		{[]cache.Write{
+			{Topic: "quotes", Partition: "AMD", Entries: data[:1]},
+			{Topic: "trades", Partition: "AMD", Entries: data[:1]},
+		}, iris.StatusConflict},
+	} {
+		body, _ := json.Marshal(BatchRequest{Writes: t.writes})
+		req, _ := http.NewRequest("POST", "/batch", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		c.Assert(rr.Result().StatusCode, Equals, t.code)
+		if t.code == iris.StatusOK {
+			resp := BatchResponse{}
+			c.Assert(json.Unmarshal(rr.Body.Bytes(), &resp), IsNil)
+			c.Assert(len(resp.Results), Equals, 2)
+			c.Assert(resp.Results[1].Accepted, Equals, 4)
+		}
+	}
+	c.Assert(len(cache.Get("trades", "AMD", nil, nil, 0)), Equals, 4)
 }
@@ -65,9 +65,12 @@ func main() {
 	Log(INFO, "Launching Slait.")
 
 	cache.Build(utils.GlobalConfig.DataDir)
-	cache.Fill()
+	if err := cache.Fill(); err != nil {
+		Log(FATAL, "Failed to load the data directory - Error: %v", err)
+	}
 
 	gocron.Every(1).Minute().Do(cache.Trim)
+	gocron.Every(1).Second().Do(cache.Sync)
 	go func() { <-gocron.Start() }()
 
 	// Start REST API
@@ -140,6 +140,9 @@ func (s *subscription) consume() {
 		case "unsubscribe":
 			return
 		default:
+			// the topic may be auto-created, otherwise the subscription
+			// waits for it to be added
+			cache.Ensure(m.Topic)
 			// update the subscription
 			val, loaded := s.m.LoadOrStore(m.Topic, m.Partitions)
 			if loaded {
@@ -224,11 +227,20 @@ func (h *Hub) run() {
 	for {
 		select {
 		case p := <-cache.Pull():
-			pub := p.(*cache.Publication)
+			var pubs []*cache.Publication
+			switch p := p.(type) {
+			case *cache.Publication:
+				pubs = []*cache.Publication{p}
+			case []*cache.Publication:
+				// the publications of a batch go out together
+				pubs = p
+			}
 			h.subscriptions.Range(func(key interface{}, value interface{}) bool {
 				sub := key.(*subscription)
-				if sub.shouldReceive(pub.Topic, pub.Partition) {
-					sub.conn.Send(pub)
+				for _, pub := range pubs {
+					if sub.shouldReceive(pub.Topic, pub.Partition) {
+						sub.conn.Send(pub)
+					}
 				}
 				return true
 			})
@@ -11,16 +11,60 @@ import (
 var Sha1hash string
 var Version string = "dev"
 
+// TrimPlan is the retention policy of the topics matching TopicMatch.  The
+// segments are deleted if any of the configured limits is exceeded.
 type TrimPlan struct {
 	TopicMatch string `yaml:"topic"`
 	Duration   string `yaml:"duration"`
+	// MaxBytes is the byte size accepted by bytefmt.ToBytes, e.g. "2G"
+	MaxBytes   string `yaml:"max_bytes"`
+	MaxEntries int64  `yaml:"max_entries"`
+	// MemoryDuration is how long the data stays in memory if shorter than
+	// on disk.  The older data is read from disk on demand.
+	MemoryDuration string `yaml:"memory_duration"`
+	// MemoryLimit is the memory budget of the topic accepted by bytefmt.ToBytes
+	MemoryLimit string `yaml:"memory_limit"`
+}
+
+// TopicPlan is the per-topic configuration applied to the topics matching TopicMatch.
+type TopicPlan struct {
+	TopicMatch string `yaml:"topic"`
+	// Sync is one of "none", "always", "batch" or "interval"
+	Sync         string `yaml:"sync"`
+	SyncInterval string `yaml:"sync_interval"`
+	// Compression is one of "none", "gzip" or "snappy"
+	Compression string `yaml:"compression"`
+	// SegmentBytes is the maximum segment file size accepted by
+	// bytefmt.ToBytes, e.g. "32K"
+	SegmentBytes string `yaml:"segment_bytes"`
+	// SegmentSpan is the maximum span of the entry timestamps in a segment,
+	// and SegmentAge is the maximum wall-clock time to write to a segment
+	SegmentSpan string `yaml:"segment_span"`
+	SegmentAge  string `yaml:"segment_age"`
+	// OutOfOrder is one of "drop", "reject", "late" or "replace", and
+	// Lateness is how old the late entries can be for "late"
+	OutOfOrder string `yaml:"out_of_order"`
+	Lateness   string `yaml:"lateness"`
+	// DedupWindow is the number of the recent entry IDs kept per partition
+	// to skip the retried entries.  The default is 1000, and negative
+	// disables it.
+	DedupWindow int `yaml:"dedup_window"`
 }
 
 type SlaitConfig struct {
-	ListenPort string     `yaml:"listen_port"`
-	LogLevel   string     `yaml:"log_level"`
-	DataDir    string     `yaml:"data_dir"`
-	TrimConfig []TrimPlan `yaml:"trim_config"`
+	ListenPort  string      `yaml:"listen_port"`
+	LogLevel    string      `yaml:"log_level"`
+	DataDir     string      `yaml:"data_dir"`
+	TrimConfig  []TrimPlan  `yaml:"trim_config"`
+	TopicConfig []TopicPlan `yaml:"topic_config"`
+	// MemoryLimit is the memory budget of the whole cache accepted by bytefmt.ToBytes
+	MemoryLimit string `yaml:"memory_limit"`
+	// AutoCreateTopics is the patterns of the topics created on the first
+	// write or subscription if they do not exist
+	AutoCreateTopics []string `yaml:"auto_create_topics"`
+	// SnapshotDir is the directory to take the snapshots into, which must be
+	// outside of DataDir.  The snapshots are disabled if it is empty.
+	SnapshotDir string `yaml:"snapshot_dir"`
 }
 
 func ParseConfig(data []byte) (err error) {
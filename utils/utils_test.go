@@ -21,3 +21,42 @@ func (s *UtilsTestSuite) TestConfig(c *C) {
 	err = ParseConfig(data)
 	c.Assert(err, IsNil)
 }
+
+func (s *UtilsTestSuite) TestTopicConfig(c *C) {
+	data := []byte(`
+listen_port: 5994
+topic_config:
+  - topic: quotes*
+    sync: interval
+    sync_interval: 1s
+    segment_bytes: 1M
+    segment_span: 1h
+`)
+	err := ParseConfig(data)
+	c.Assert(err, IsNil)
+	c.Assert(len(GlobalConfig.TopicConfig), Equals, 1)
+	c.Assert(GlobalConfig.TopicConfig[0].TopicMatch, Equals, "quotes*")
+	c.Assert(GlobalConfig.TopicConfig[0].Sync, Equals, "interval")
+	c.Assert(GlobalConfig.TopicConfig[0].SyncInterval, Equals, "1s")
+	c.Assert(GlobalConfig.TopicConfig[0].SegmentBytes, Equals, "1M")
+	c.Assert(GlobalConfig.TopicConfig[0].SegmentSpan, Equals, "1h")
+}
+
+func (s *UtilsTestSuite) TestTrimConfig(c *C) {
+	data := []byte(`
+listen_port: 5994
+trim_config:
+  - topic: bars*
+    duration: 24h
+    max_bytes: 2G
+    max_entries: 1000000
+    memory_duration: 1h
+`)
+	err := ParseConfig(data)
+	c.Assert(err, IsNil)
+	c.Assert(len(GlobalConfig.TrimConfig), Equals, 1)
+	c.Assert(GlobalConfig.TrimConfig[0].Duration, Equals, "24h")
+	c.Assert(GlobalConfig.TrimConfig[0].MaxBytes, Equals, "2G")
+	c.Assert(GlobalConfig.TrimConfig[0].MaxEntries, Equals, int64(1000000))
+	c.Assert(GlobalConfig.TrimConfig[0].MemoryDuration, Equals, "1h")
+}